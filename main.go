@@ -30,61 +30,431 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// operationWaitTimeout bounds the disruptive procedures when the client asks to wait for the outcome; longer
+// operations (e.g. with a long rollback timeout) are better followed with WatchOperation
+const operationWaitTimeout = 5 * time.Minute
+
+// procedureWriteTimeouts override the server's WriteTimeout for procedures that take longer. Streams are expected
+// to stay open, so they get 0, no deadline at all.
+var procedureWriteTimeouts = map[string]time.Duration{
+	devconnect.WiFiServiceWatchScanProcedure:      0,
+	devconnect.WiFiServiceWatchOperationProcedure: 0,
+	devconnect.WiFiServiceConnectProcedure:        operationWaitTimeout,
+	devconnect.WiFiServiceDisconnectProcedure:     operationWaitTimeout,
+	devconnect.WiFiServiceStartHotspotProcedure:   operationWaitTimeout,
+}
+
+func writeTimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout, ok := procedureWriteTimeouts[r.URL.Path]; ok {
+			// A zero deadline means no deadline
+			var deadline time.Time
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout)
+			}
+			if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+				log.Printf("Failed to set write deadline for %s: %v", r.URL.Path, err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	defaultScanTimeSeconds = 15
+
+	defaultWatchScanIntervalSeconds = 30
+	minWatchScanIntervalSeconds     = 10
+)
+
 type wifiServer struct {
-	dbusConn *dbus.Conn
+	dbusConn   *dbus.Conn
+	scanCache  *pkg.ScanCache
+	operations *pkg.Operations
+	// secrets is the secret agent's store; nil without -secret-agent
+	secrets     *pkg.SecretStore
+	activations *pkg.ActivationTracker
 }
 
 func (w wifiServer) Scan(ctx context.Context, c *connect.Request[dev.WiFiScanRequest]) (*connect.Response[dev.WiFiScanResponse], error) {
-	var maxScanTimeSeconds int = 0
+	var maxScanTimeSeconds int = defaultScanTimeSeconds
 	if c.Msg.MaxTimeSeconds > 0 {
 		maxScanTimeSeconds = int(c.Msg.MaxTimeSeconds)
 	}
 	if maxScanTimeSeconds > 60 {
 		return nil, errors.New("Scan MaxTimeSeconds is capped at 60 seconds")
 	}
+	if err := pkg.ValidateScanOptions(c.Msg); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
 	scanCtx, cancelScanCtx := context.WithTimeout(ctx, time.Second*time.Duration(maxScanTimeSeconds))
 	defer cancelScanCtx()
 
-	accessPoints, err := pkg.WifiScan(scanCtx, w.dbusConn, "")
+	scanResult, err := w.scanCache.Scan(scanCtx, c.Msg.NetworkInterface, c.Msg.CycleHotspot)
 	if err != nil {
+		if errors.Is(err, pkg.ErrNoWifiDevice) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
 		return nil, err
 	}
+	pkg.ApplyScanOptions(scanResult, c.Msg)
 
 	return &connect.Response[dev.WiFiScanResponse]{
 		Msg: &dev.WiFiScanResponse{
-			ScanResult: &dev.WiFiScanResult{
-				AccessPoints: accessPoints,
-			},
+			ScanResult: scanResult,
 		},
 	}, nil
 
 }
 
+func (w wifiServer) WatchScan(ctx context.Context, c *connect.Request[dev.WiFiWatchScanRequest], stream *connect.ServerStream[dev.WiFiWatchScanResponse]) error {
+	scanIntervalSeconds := defaultWatchScanIntervalSeconds
+	if c.Msg.ScanIntervalSeconds > 0 {
+		scanIntervalSeconds = int(c.Msg.ScanIntervalSeconds)
+	}
+	if scanIntervalSeconds < minWatchScanIntervalSeconds {
+		scanIntervalSeconds = minWatchScanIntervalSeconds
+	}
+
+	err := pkg.WatchScan(ctx, w.dbusConn, c.Msg.NetworkInterface, time.Second*time.Duration(scanIntervalSeconds), stream.Send)
+	if errors.Is(err, pkg.ErrNoWifiDevice) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+
+	return err
+}
+
 func (w wifiServer) Connect(ctx context.Context, c *connect.Request[dev.WiFiConnectRequest]) (*connect.Response[dev.WiFiConnectResponse], error) {
-	connectionCtx, cancelConnectionCtx := context.WithTimeout(ctx, time.Minute)
-	defer cancelConnectionCtx()
+	if err := pkg.ValidateConnectRequest(c.Msg); err != nil {
+		return nil, connectError(err)
+	}
+
+	// Turn down requests for a missing device before going async, so the client still gets NotFound
+	if err := pkg.CheckConnectDevice(ctx, w.dbusConn, c.Msg); err != nil {
+		return nil, connectError(err)
+	}
 
-	err := pkg.ConnectWiFi(connectionCtx, w.dbusConn, c.Msg)
+	operationID, err := w.operations.Start(c.Msg.OperationId, "Connect")
 	if err != nil {
-		return nil, err
+		return nil, connect.NewError(connect.CodeAlreadyExists, err)
+	}
+
+	timeout := time.Minute
+	if c.Msg.Rollback.GetEnabled() {
+		timeout = pkg.RollbackTimeout(c.Msg.Rollback)
+	}
+	err = w.runOperation(ctx, operationID, timeout, c.Msg.Wait, c.Msg.Rollback.GetEnabled(), func(ctx context.Context) error {
+		return pkg.ConnectWiFi(ctx, w.dbusConn, w.secrets, c.Msg, w.operations.Progress(operationID))
+	})
+	if err != nil {
+		return nil, connectError(err)
 	}
 
 	return &connect.Response[dev.WiFiConnectResponse]{
 		Msg: &dev.WiFiConnectResponse{
-			//🤷
-			Success: true,
+			Success:     w.operationSucceeded(operationID),
+			OperationId: operationID,
 		},
 	}, nil
 }
 
+// connectError maps the errors of Connect to connect codes
+func connectError(err error) error {
+	if errors.Is(err, pkg.ErrInvalidNetworkInterface) || errors.Is(err, pkg.ErrInvalidIPConfig) ||
+		errors.Is(err, pkg.ErrInvalidRollbackOptions) || errors.Is(err, pkg.ErrInvalidPersistMode) ||
+		errors.Is(err, pkg.ErrInvalidEAPConfig) || errors.Is(err, pkg.ErrInvalidConnectOptions) ||
+		errors.Is(err, pkg.ErrInvalidConnectRequest) {
+		return pkg.InvalidArgumentError(err)
+	}
+	if errors.Is(err, pkg.ErrNoWifiDevice) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+
+	return err
+}
+
 func (w wifiServer) Disconnect(ctx context.Context, c *connect.Request[dev.WiFiDisconnectRequest]) (*connect.Response[dev.WiFiDisconnectResponse], error) {
-	//TODO implement me
-	panic("implement me")
+	// Resolve what the request matches before going async, so NotFound still reaches the client
+	plan, err := pkg.PlanDisconnect(ctx, w.dbusConn, c.Msg)
+	if err != nil {
+		return nil, disconnectError(err)
+	}
+
+	operationID, err := w.operations.Start(c.Msg.OperationId, "Disconnect")
+	if err != nil {
+		return nil, connect.NewError(connect.CodeAlreadyExists, err)
+	}
+
+	timeout := time.Minute
+	if c.Msg.Rollback.GetEnabled() {
+		timeout = pkg.RollbackTimeout(c.Msg.Rollback)
+	}
+	response := &dev.WiFiDisconnectResponse{}
+	err = w.runOperation(ctx, operationID, timeout, c.Msg.Wait, c.Msg.Rollback.GetEnabled(), func(ctx context.Context) error {
+		result, err := pkg.DisconnectWiFi(ctx, w.dbusConn, plan, w.operations.Progress(operationID))
+		if err != nil {
+			return err
+		}
+		w.operations.SetDisconnectResult(operationID, result)
+		response = result
+		return nil
+	})
+	if err != nil {
+		return nil, disconnectError(err)
+	}
+	response.OperationId = operationID
+
+	return &connect.Response[dev.WiFiDisconnectResponse]{
+		Msg: response,
+	}, nil
+}
+
+// disconnectError maps the errors of Disconnect to connect codes
+func disconnectError(err error) error {
+	if errors.Is(err, pkg.ErrInvalidRollbackOptions) {
+		return pkg.InvalidArgumentError(err)
+	}
+	if errors.Is(err, pkg.ErrNoWifiDevice) || errors.Is(err, pkg.ErrNoMatchingConnection) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+
+	return err
+}
+
+func (w wifiServer) StartHotspot(ctx context.Context, c *connect.Request[dev.WiFiStartHotspotRequest]) (*connect.Response[dev.WiFiStartHotspotResponse], error) {
+	hotspotConfig := pkg.HotspotConfig{
+		SSID:          c.Msg.SSID,
+		Password:      c.Msg.Password,
+		InterfaceName: c.Msg.NetworkInterface,
+		Band:          c.Msg.Band,
+		Channel:       c.Msg.Channel,
+	}
+	// -1 leaves the channel to the driver, which is what 0 means to StartHotspot
+	if hotspotConfig.Channel == -1 {
+		hotspotConfig.Channel = 0
+	}
+	if err := pkg.ValidateHotspotConfig(hotspotConfig); err != nil {
+		return nil, pkg.InvalidArgumentError(err)
+	}
+
+	operationID, err := w.operations.Start(c.Msg.OperationId, "StartHotspot")
+	if err != nil {
+		return nil, connect.NewError(connect.CodeAlreadyExists, err)
+	}
+
+	err = w.runOperation(ctx, operationID, time.Minute, c.Msg.Wait, true, func(ctx context.Context) error {
+		// Once the radio is in AP mode it can't scan anymore, so take a snapshot for provisioning clients first
+		if err := w.scanCache.Refresh(ctx, hotspotConfig.InterfaceName); err != nil {
+			log.Printf("Failed to scan before starting hotspot: %v", err)
+		}
+		if c.Msg.Channel == 0 {
+			if err := pickHotspotChannel(w.scanCache, &hotspotConfig, c.Msg.AllowDfs); err != nil {
+				return err
+			}
+		}
+		return pkg.StartHotspot(ctx, w.dbusConn, w.secrets, hotspotConfig, w.operations.Progress(operationID))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &connect.Response[dev.WiFiStartHotspotResponse]{
+		Msg: &dev.WiFiStartHotspotResponse{
+			OperationId: operationID,
+		},
+	}, nil
+}
+
+// pickHotspotChannel sets config's channel to the least congested one, judging by the cached scan results of its
+// interface. A band no channel can be recommended in is an invalid argument, with the violation attached.
+func pickHotspotChannel(scanCache *pkg.ScanCache, config *pkg.HotspotConfig, allowDFS bool) error {
+	band := config.Band
+	if band == dev.WiFiBand_WIFI_BAND_UNKNOWN {
+		band = dev.WiFiBand_WIFI_BAND_2_4_GHZ
+	}
+
+	scores, err := pkg.RecommendChannel(scanCache.Cached(config.InterfaceName).AccessPoints, band, allowDFS)
+	if err != nil {
+		return pkg.InvalidArgumentError(errors.Wrap(err, "failed to recommend a hotspot channel"))
+	}
+	config.Channel = scores[0].Channel
+	log.Printf("Using hotspot channel %d (score %.2f, %d overlapping access points)", scores[0].Channel, scores[0].Score, scores[0].AccessPointCount)
+
+	return nil
+}
+
+// runOperation runs operation id, giving it timeout. Unless wait is set, it runs in the background and runOperation
+// returns right away. Background operations, and detached ones (e.g. guarded by a checkpoint), are seen through
+// even when the client goes away, which the operation itself may well cause; the outcome is recorded either way.
+func (w wifiServer) runOperation(ctx context.Context, id string, timeout time.Duration, wait bool, detach bool, operation func(ctx context.Context) error) error {
+	if !wait || detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	run := func() error {
+		operationCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := operation(operationCtx)
+		w.operations.Finish(id, err)
+		return err
+	}
+
+	if wait {
+		return run()
+	}
+	go func() {
+		if err := run(); err != nil {
+			log.Printf("Operation %s failed: %v", id, err)
+		}
+	}()
+
+	return nil
+}
+
+// operationSucceeded reports whether operation id is known to have succeeded; false while it's still running
+func (w wifiServer) operationSucceeded(id string) bool {
+	operation, err := w.operations.Get(id)
+	return err == nil && operation.State == dev.WiFiOperationState_WIFI_OPERATION_STATE_SUCCEEDED
+}
+
+func (w wifiServer) GetOperation(ctx context.Context, c *connect.Request[dev.WiFiGetOperationRequest]) (*connect.Response[dev.WiFiGetOperationResponse], error) {
+	operation, err := w.operations.Get(c.Msg.OperationId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeNotFound, err)
+	}
+
+	return &connect.Response[dev.WiFiGetOperationResponse]{
+		Msg: &dev.WiFiGetOperationResponse{
+			Operation: operation,
+		},
+	}, nil
+}
+
+func (w wifiServer) WatchOperation(ctx context.Context, c *connect.Request[dev.WiFiWatchOperationRequest], stream *connect.ServerStream[dev.WiFiWatchOperationResponse]) error {
+	err := w.operations.Watch(ctx, c.Msg.OperationId, func(operation *dev.WiFiOperation) error {
+		return stream.Send(&dev.WiFiWatchOperationResponse{
+			Operation: operation,
+		})
+	})
+	if errors.Is(err, pkg.ErrOperationNotFound) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+
+	return err
+}
+
+func (w wifiServer) ListSavedNetworks(ctx context.Context, c *connect.Request[dev.WiFiListSavedNetworksRequest]) (*connect.Response[dev.WiFiListSavedNetworksResponse], error) {
+	networks, err := pkg.ListSavedNetworks(ctx, w.dbusConn, w.secrets, c.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connect.Response[dev.WiFiListSavedNetworksResponse]{
+		Msg: networks,
+	}, nil
+}
+
+func (w wifiServer) GetSavedNetwork(ctx context.Context, c *connect.Request[dev.WiFiGetSavedNetworkRequest]) (*connect.Response[dev.WiFiGetSavedNetworkResponse], error) {
+	network, err := pkg.GetSavedNetwork(ctx, w.dbusConn, w.secrets, c.Msg)
+	if err != nil {
+		return nil, savedNetworkError(err)
+	}
+
+	return &connect.Response[dev.WiFiGetSavedNetworkResponse]{
+		Msg: network,
+	}, nil
+}
+
+func (w wifiServer) UpdateSavedNetwork(ctx context.Context, c *connect.Request[dev.WiFiUpdateSavedNetworkRequest]) (*connect.Response[dev.WiFiUpdateSavedNetworkResponse], error) {
+	network, err := pkg.UpdateSavedNetwork(ctx, w.dbusConn, w.secrets, c.Msg)
+	if err != nil {
+		return nil, savedNetworkError(err)
+	}
+
+	return &connect.Response[dev.WiFiUpdateSavedNetworkResponse]{
+		Msg: network,
+	}, nil
+}
+
+func (w wifiServer) ForgetNetwork(ctx context.Context, c *connect.Request[dev.WiFiForgetNetworkRequest]) (*connect.Response[dev.WiFiForgetNetworkResponse], error) {
+	forgotten, err := pkg.ForgetNetwork(ctx, w.dbusConn, c.Msg)
+	if err != nil {
+		return nil, savedNetworkError(err)
+	}
+
+	return &connect.Response[dev.WiFiForgetNetworkResponse]{
+		Msg: forgotten,
+	}, nil
+}
+
+func (w wifiServer) ReorderNetworks(ctx context.Context, c *connect.Request[dev.WiFiReorderNetworksRequest]) (*connect.Response[dev.WiFiReorderNetworksResponse], error) {
+	networks, err := pkg.ReorderNetworks(ctx, w.dbusConn, w.secrets, c.Msg)
+	if err != nil {
+		return nil, savedNetworkError(err)
+	}
+
+	return &connect.Response[dev.WiFiReorderNetworksResponse]{
+		Msg: networks,
+	}, nil
+}
+
+// savedNetworkError maps the errors of the saved network procedures to connect codes
+func savedNetworkError(err error) error {
+	switch {
+	case errors.Is(err, pkg.ErrSavedNetworkNotFound), errors.Is(err, pkg.ErrNoWifiDevice):
+		return connect.NewError(connect.CodeNotFound, err)
+	case errors.Is(err, pkg.ErrInvalidSavedNetworkUpdate), errors.Is(err, pkg.ErrInvalidIPConfig), errors.Is(err, pkg.ErrInvalidNetworkInterface):
+		return pkg.InvalidArgumentError(err)
+	}
+
+	return err
 }
 
 func (w wifiServer) GetStatus(ctx context.Context, c *connect.Request[dev.WiFiGetStatusRequest]) (*connect.Response[dev.WiFiGetStatusResponse], error) {
-	//TODO implement me
-	panic("implement me")
+	status, err := pkg.WifiStatus(ctx, w.dbusConn, w.activations, c.Msg.NetworkInterface)
+	if err != nil {
+		if errors.Is(err, pkg.ErrNoWifiDevice) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return &connect.Response[dev.WiFiGetStatusResponse]{
+		Msg: status,
+	}, nil
+}
+
+func (w wifiServer) RecommendChannel(ctx context.Context, c *connect.Request[dev.WiFiRecommendChannelRequest]) (*connect.Response[dev.WiFiRecommendChannelResponse], error) {
+	band := c.Msg.Band
+	if band == dev.WiFiBand_WIFI_BAND_UNKNOWN {
+		band = dev.WiFiBand_WIFI_BAND_2_4_GHZ
+	}
+
+	scanCtx, cancelScanCtx := context.WithTimeout(ctx, time.Second*defaultScanTimeSeconds)
+	defer cancelScanCtx()
+
+	scanResult, err := w.scanCache.Scan(scanCtx, c.Msg.NetworkInterface, false)
+	if err != nil {
+		if errors.Is(err, pkg.ErrNoWifiDevice) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	scores, err := pkg.RecommendChannel(scanResult.AccessPoints, band, c.Msg.AllowDfs)
+	if err != nil {
+		return nil, pkg.InvalidArgumentError(err)
+	}
+
+	return &connect.Response[dev.WiFiRecommendChannelResponse]{
+		Msg: &dev.WiFiRecommendChannelResponse{
+			Band:               band,
+			RecommendedChannel: scores[0].Channel,
+			Scores:             scores,
+			Stale:              scanResult.Stale,
+		},
+	}, nil
 }
 
 var _ devconnect.WiFiServiceHandler = (*wifiServer)(nil)
@@ -109,13 +479,25 @@ var (
 	hotspotSSID      = flag.String("hotspot-ssid", "", "SSID of the hotspot")
 	hotspotPass      = flag.String("hotspot-pass", "", "Password of the hotspot")
 	hotspotInterface = flag.String("hotspot-interface", "", "Interface to use for the hotspot (e.g. wlan0)")
+	hotspotBand      = flag.String("hotspot-band", "2.4", "Band to use for the hotspot (2.4 or 5)")
+	hotspotChannel   = flag.Int("hotspot-channel", 0, "Channel to use for the hotspot; 0 picks the least congested one from a scan, -1 leaves it to the driver")
+	hotspotAllowDFS  = flag.Bool("hotspot-allow-dfs", false, "Allow picking a DFS channel for a 5 GHz hotspot")
 
 	modeScan      = flag.Bool("scan", false, "Scan for WiFi networks")
 	scanInterface = flag.String("scan-interface", "", "Interface to use for scanning (e.g. wlan0)")
+
+	certificateDir = flag.String("certificate-dir", pkg.CertificateDir, "Directory to store EAP certificates and keys in")
+
+	secretAgent   = flag.Bool("secret-agent", false, "Keep Wi-Fi passwords in an encrypted store and hand them to NetworkManager as its secret agent, instead of letting it write them to its profiles in plaintext")
+	secretStore   = flag.String("secret-store", "/var/lib/iotnetlab/secrets", "Encrypted store for Wi-Fi passwords")
+	secretKeyFile = flag.String("secret-key-file", "", "Key file (32 raw bytes or 64 hex digits) protecting the secret store, required with -secret-agent; keep it off the device image, or the store protects nothing")
+
+	scanCacheInterval = flag.Duration("scan-cache-interval", time.Minute, "How often to scan in the background while not serving a hotspot")
 )
 
 func main() {
 	flag.Parse()
+	pkg.CertificateDir = *certificateDir
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -126,26 +508,77 @@ func main() {
 	}
 	defer conn.Close()
 
+	var secrets *pkg.SecretStore
+	if *secretAgent {
+		store, err := pkg.OpenSecretStore(*secretStore, *secretKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to open secret store: %v", err)
+		}
+		if err := pkg.RegisterSecretAgent(ctx, conn, store); err != nil {
+			log.Fatalf("Failed to register secret agent: %v", err)
+		}
+		secrets = store
+	}
+
+	activations := pkg.NewActivationTracker(conn)
+	go activations.Run(ctx)
+
+	scanCache := pkg.NewScanCache(conn)
+	go scanCache.Run(ctx, *scanCacheInterval)
+
 	if *hotspotSSID != "" && *hotspotPass != "" {
-		err := pkg.StartHotspot(ctx, conn, *hotspotSSID, *hotspotPass, *hotspotInterface)
+		hotspotConfig := pkg.HotspotConfig{
+			SSID:          *hotspotSSID,
+			Password:      *hotspotPass,
+			InterfaceName: *hotspotInterface,
+			Band:          dev.WiFiBand_WIFI_BAND_2_4_GHZ,
+		}
+		switch *hotspotBand {
+		case "2.4":
+		case "5":
+			hotspotConfig.Band = dev.WiFiBand_WIFI_BAND_5_GHZ
+		default:
+			log.Fatalf("Unsupported hotspot band: %s", *hotspotBand)
+		}
+
+		// Once the radio is in AP mode it can't scan anymore, so take a snapshot for provisioning clients first
+		if err := scanCache.Refresh(ctx, *hotspotInterface); err != nil {
+			log.Printf("Failed to scan before starting hotspot: %v", err)
+		}
+
+		if *hotspotChannel > 0 {
+			hotspotConfig.Channel = int32(*hotspotChannel)
+		} else if *hotspotChannel == 0 {
+			if err := pickHotspotChannel(scanCache, &hotspotConfig, *hotspotAllowDFS); err != nil {
+				log.Fatalf("Failed to start hotspot: %v", err)
+			}
+		}
+
+		err := pkg.StartHotspot(ctx, conn, secrets, hotspotConfig, nil)
 		if err != nil {
 			log.Fatalf("Failed to start hotspot: %v", err)
 		}
 	}
 
 	if *modeScan {
-		accessPoints, err := pkg.WifiScan(ctx, conn, *scanInterface)
+		scanCtx, cancelScanCtx := context.WithTimeout(ctx, time.Second*defaultScanTimeSeconds)
+		scanResult, err := pkg.WifiScan(scanCtx, conn, *scanInterface)
+		cancelScanCtx()
 		if err != nil {
 			log.Fatalf("Failed to scan for WiFi networks: %v", err)
 		}
 
-		for _, ap := range accessPoints {
-			log.Printf("SSID: %s, Frequency: %d, Strength: %d, Security: %s, Channel: %d\n", ap.SSID, ap.Frequency, ap.GetRSSI(), ap.SecurityType.String(), ap.GetChannel())
+		for _, ap := range scanResult.AccessPoints {
+			log.Printf("SSID: %s, Frequency: %d, RSSI: %d dBm, Security: %s, Channel: %d\n", ap.SSID, ap.Frequency, ap.GetRSSI(), ap.SecurityType.String(), ap.GetChannel())
 		}
 	}
 
 	srv := &wifiServer{
-		dbusConn: conn,
+		dbusConn:    conn,
+		scanCache:   scanCache,
+		operations:  pkg.NewOperations(),
+		secrets:     secrets,
+		activations: activations,
 	}
 
 	httpMux := http.NewServeMux()
@@ -212,7 +645,7 @@ func main() {
 		Debug: cfg.Debug,
 	})
 
-	withLogging := loggingMiddleware(httpMux)
+	withLogging := loggingMiddleware(writeTimeoutMiddleware(httpMux))
 	withCors := corsConfig.Handler(withLogging)
 	httpServer := http.Server{
 		Addr:              cfg.Host + ":" + cfg.Port,
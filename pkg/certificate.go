@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// validateCertificates adds a violation for field unless contents are certificates (PEM, or base64 encoded DER)
+// that are valid at now, and returns the certificates that could be parsed
+func validateCertificates(v *violations, field string, contents string, now time.Time) []*x509.Certificate {
+	certs, err := parseCertificates(contents)
+	if err != nil {
+		v.add(field, "%v", err)
+		return nil
+	}
+
+	for _, cert := range certs {
+		if now.After(cert.NotAfter) {
+			v.add(field, "certificate %q expired on %s", cert.Subject.String(), cert.NotAfter.Format(time.DateOnly))
+		} else if now.Before(cert.NotBefore) {
+			v.add(field, "certificate %q is not valid until %s; is the clock set?", cert.Subject.String(), cert.NotBefore.Format(time.DateOnly))
+		}
+	}
+
+	return certs
+}
+
+// validatePrivateKey adds a violation for field unless contents are a private key (PEM, or base64 encoded DER)
+// that can be used: encrypted keys need a password, and a key has to belong to cert when there is one
+func validatePrivateKey(v *violations, field string, contents string, hasPassword bool, cert *x509.Certificate) {
+	block, err := privateKeyBlock(contents)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	if isEncryptedPrivateKey(block) {
+		if !hasPassword {
+			v.add(field, "the private key is encrypted, so private_key_password is required")
+		}
+		return
+	}
+
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	if cert == nil {
+		return
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return
+	}
+	if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && !publicKey.Equal(cert.PublicKey) {
+		v.add(field, "the private key doesn't belong to client_certificate")
+	}
+}
+
+// parseCertificates parses PEM certificates (possibly several, e.g. a CA bundle) or base64 encoded DER ones
+func parseCertificates(contents string) ([]*x509.Certificate, error) {
+	if blocks := pemBlocks(contents); len(blocks) > 0 {
+		certs := make([]*x509.Certificate, 0, len(blocks))
+		for _, block := range blocks {
+			if block.Type != "CERTIFICATE" {
+				return nil, fmt.Errorf("expected certificates, found a %s", block.Type)
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		}
+		return certs, nil
+	}
+
+	der, ok := base64DER(contents)
+	if !ok {
+		return nil, errors.New("not a PEM or base64 encoded DER certificate")
+	}
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+
+	return certs, nil
+}
+
+// privateKeyBlock returns the private key in contents as a PEM block, working out the type of a base64 encoded
+// DER key
+func privateKeyBlock(contents string) (*pem.Block, error) {
+	if blocks := pemBlocks(contents); len(blocks) > 0 {
+		if len(blocks) != 1 || !strings.HasSuffix(blocks[0].Type, "PRIVATE KEY") {
+			return nil, errors.New("expected a single private key")
+		}
+		return blocks[0], nil
+	}
+
+	der, ok := base64DER(contents)
+	if !ok {
+		return nil, errors.New("not a PEM or base64 encoded DER private key")
+	}
+	for _, blockType := range []string{"PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY"} {
+		block := &pem.Block{Type: blockType, Bytes: der}
+		if _, err := parsePrivateKey(block); err == nil {
+			return block, nil
+		}
+	}
+
+	// DER that isn't a plain key is most likely an encrypted PKCS #8 one
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}, nil
+}
+
+func isEncryptedPrivateKey(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	var key crypto.PrivateKey
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+
+	return key, nil
+}
+
+// certificatePEM returns certificates or a private key that passed validation as PEM, which is how they're written
+// to CertificateDir; PEM contents are returned as they are
+func certificatePEM(contents string, isPrivateKey bool) string {
+	if len(pemBlocks(contents)) > 0 {
+		return contents
+	}
+
+	if isPrivateKey {
+		block, err := privateKeyBlock(contents)
+		if err != nil {
+			return contents
+		}
+		return string(pem.EncodeToMemory(block))
+	}
+
+	certs, err := parseCertificates(contents)
+	if err != nil {
+		return contents
+	}
+	var b strings.Builder
+	for _, cert := range certs {
+		b.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+
+	return b.String()
+}
+
+// pemBlocks returns the PEM blocks in contents; none when it isn't PEM
+func pemBlocks(contents string) []*pem.Block {
+	var blocks []*pem.Block
+	rest := []byte(contents)
+	for {
+		block, remaining := pem.Decode(rest)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+		rest = remaining
+	}
+}
+
+// base64DER decodes contents as base64 encoded DER, ignoring line breaks and other whitespace
+func base64DER(contents string) ([]byte, bool) {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(contents), ""))
+	return der, err == nil && len(der) > 0
+}
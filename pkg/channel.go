@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// ErrUnsupportedChannelBand is returned by RecommendChannel for bands it can't recommend a channel in
+var ErrUnsupportedChannelBand = errors.New("unsupported band for channel recommendation")
+
+var (
+	// channels 12-13 aren't allowed everywhere, so stick to the ones every regulatory domain permits
+	channels2_4GHz = []int32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	// the only non-overlapping 20 MHz channels in 2.4 GHz; preferred when scores tie
+	nonOverlapping2_4GHz = map[int32]bool{1: true, 6: true, 11: true}
+
+	channels5GHz    = []int32{36, 40, 44, 48, 149, 153, 157, 161, 165}
+	channels5GHzDFS = []int32{52, 56, 60, 64, 100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144}
+)
+
+// RecommendChannel scores every candidate 20 MHz channel in band against the access points heard in a scan and
+// returns the scores, best (lowest) first. Each overlapping access point adds its signal weight (0.1 for barely
+// audible up to 1 for -40 dBm and above), scaled by how much it overlaps: on 2.4 GHz overlap falls off with channel
+// distance, on 5 GHz an access point overlaps every 20 MHz channel inside its (possibly 40/80/160 MHz) channel. DFS
+// channels are only considered with allowDFS, since a radar event forces the hotspot off the channel.
+func RecommendChannel(accessPoints []*dev.WiFiAccessPoint, band dev.WiFiBand, allowDFS bool) ([]*dev.WiFiChannelScore, error) {
+	var candidates []int32
+	switch band {
+	case dev.WiFiBand_WIFI_BAND_2_4_GHZ:
+		candidates = channels2_4GHz
+	case dev.WiFiBand_WIFI_BAND_5_GHZ:
+		candidates = channels5GHz
+		if allowDFS {
+			candidates = append(append([]int32{}, channels5GHz...), channels5GHzDFS...)
+		}
+	default:
+		var v violations
+		v.add("band", "channel recommendation is only supported for 2.4 and 5 GHz, not %s", band)
+		return nil, v.err(ErrUnsupportedChannelBand)
+	}
+
+	scores := make([]*dev.WiFiChannelScore, 0, len(candidates))
+	for _, channel := range candidates {
+		score := &dev.WiFiChannelScore{
+			Channel:   channel,
+			Frequency: channelToFrequency(band, channel),
+			Dfs:       isDFSChannel(band, channel),
+		}
+
+		for _, ap := range accessPoints {
+			if ap.Band != band || ap.Channel == 0 {
+				continue
+			}
+
+			var overlap float64
+			if band == dev.WiFiBand_WIFI_BAND_2_4_GHZ {
+				overlap = overlap2_4GHz(channel, ap.Channel, ap.BandwidthMhz)
+			} else {
+				overlap = overlap5GHz(channel, ap.Channel, ap.BandwidthMhz)
+			}
+			if overlap == 0 {
+				continue
+			}
+
+			score.AccessPointCount++
+			score.Score += overlap * signalWeight(ap.RssiDbm)
+		}
+
+		scores = append(scores, score)
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score < scores[j].Score
+		}
+		if band == dev.WiFiBand_WIFI_BAND_2_4_GHZ && nonOverlapping2_4GHz[scores[i].Channel] != nonOverlapping2_4GHz[scores[j].Channel] {
+			return nonOverlapping2_4GHz[scores[i].Channel]
+		}
+		return scores[i].Channel < scores[j].Channel
+	})
+
+	return scores, nil
+}
+
+// signalWeight maps dBm onto 0.1 (-100 dBm or weaker) .. 1 (-40 dBm or stronger)
+func signalWeight(rssiDbm int32) float64 {
+	weight := float64(rssiDbm+100) / 60
+	if weight < 0.1 {
+		return 0.1
+	}
+	if weight > 1 {
+		return 1
+	}
+	return weight
+}
+
+// overlap2_4GHz is 1 for the same channel, falling off linearly to 0 five channels (20 MHz) away. A 40 MHz access
+// point reaches four channels further, but we don't know in which direction, so both sides are counted.
+func overlap2_4GHz(channel, apChannel, apBandwidthMhz int32) float64 {
+	reach := float64(5)
+	if apBandwidthMhz > 20 {
+		reach += float64(apBandwidthMhz-20) / 5
+	}
+
+	distance := float64(channel - apChannel)
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance >= reach {
+		return 0
+	}
+
+	return 1 - distance/reach
+}
+
+// overlap5GHz is 1 if channel falls inside the block of 20 MHz channels the access point occupies, 0 otherwise.
+// Wider 5 GHz channels are aligned blocks (e.g. 80 MHz: 36-48, 52-64, ...), so the block follows from the primary
+// channel and the width.
+func overlap5GHz(channel, apChannel, apBandwidthMhz int32) float64 {
+	width := apBandwidthMhz
+	if width < 20 {
+		width = 20
+	}
+	blockSpan := (width / 20) * 4 // in channel numbers
+
+	base := int32(36)
+	if apChannel >= 149 {
+		base = 149
+	}
+	if apChannel < base {
+		return 0
+	}
+
+	low := base + ((apChannel-base)/blockSpan)*blockSpan
+	high := low + blockSpan - 4
+	if channel >= low && channel <= high {
+		return 1
+	}
+
+	return 0
+}
+
+func isDFSChannel(band dev.WiFiBand, channel int32) bool {
+	return band == dev.WiFiBand_WIFI_BAND_5_GHZ && channel >= 52 && channel <= 144
+}
+
+// channelToFrequency is the inverse of frequencyToBandChannel for the bands we recommend channels in
+func channelToFrequency(band dev.WiFiBand, channel int32) int32 {
+	switch band {
+	case dev.WiFiBand_WIFI_BAND_2_4_GHZ:
+		if channel == 14 {
+			return 2484
+		}
+		return 2407 + channel*5
+	case dev.WiFiBand_WIFI_BAND_5_GHZ:
+		return 5000 + channel*5
+	}
+
+	return 0
+}
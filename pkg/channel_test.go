@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+func TestOverlap2_4GHz(t *testing.T) {
+	tests := []struct {
+		name           string
+		channel        int32
+		apChannel      int32
+		apBandwidthMhz int32
+		want           float64
+	}{
+		{"same channel", 6, 6, 20, 1},
+		{"one channel away", 7, 6, 20, 0.8},
+		{"four channels away", 2, 6, 20, 0.2},
+		{"five channels away", 1, 6, 20, 0},
+		{"non-overlapping channels", 11, 6, 20, 0},
+		{"unknown bandwidth counts as 20 MHz", 7, 6, 0, 0.8},
+		{"40 MHz same channel", 6, 6, 40, 1},
+		{"40 MHz five channels away", 11, 6, 40, float64(4) / 9},
+		{"40 MHz reaches both sides", 1, 6, 40, float64(4) / 9},
+		{"40 MHz nine channels away", 10, 1, 40, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overlap2_4GHz(tt.channel, tt.apChannel, tt.apBandwidthMhz); !approxEqual(got, tt.want) {
+				t.Errorf("overlap2_4GHz(%d, %d, %d) = %v, want %v", tt.channel, tt.apChannel, tt.apBandwidthMhz, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlap5GHz(t *testing.T) {
+	tests := []struct {
+		name           string
+		apChannel      int32
+		apBandwidthMhz int32
+		// the 20 MHz channels the access point occupies
+		want []int32
+	}{
+		{"20 MHz", 36, 20, []int32{36}},
+		{"unknown bandwidth counts as 20 MHz", 44, 0, []int32{44}},
+		{"40 MHz lower primary", 36, 40, []int32{36, 40}},
+		{"40 MHz upper primary", 40, 40, []int32{36, 40}},
+		{"40 MHz second block", 48, 40, []int32{44, 48}},
+		{"40 MHz DFS", 104, 40, []int32{100, 104}},
+		{"40 MHz upper band", 157, 40, []int32{157, 161}},
+		{"80 MHz", 44, 80, []int32{36, 40, 44, 48}},
+		{"80 MHz DFS", 60, 80, []int32{52, 56, 60, 64}},
+		{"80 MHz after the gap", 116, 80, []int32{116, 120, 124, 128}},
+		{"80 MHz upper band", 161, 80, []int32{149, 153, 157, 161}},
+		{"160 MHz", 52, 160, []int32{36, 40, 44, 48, 52, 56, 60, 64}},
+		{"160 MHz DFS", 128, 160, []int32{100, 104, 108, 112, 116, 120, 124, 128}},
+		{"160 MHz upper band", 149, 160, []int32{149, 153, 157, 161, 165}},
+	}
+
+	candidates := append(append([]int32{}, channels5GHz...), channels5GHzDFS...)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			occupied := map[int32]bool{}
+			for _, channel := range tt.want {
+				occupied[channel] = true
+			}
+
+			for _, channel := range candidates {
+				want := float64(0)
+				if occupied[channel] {
+					want = 1
+				}
+				if got := overlap5GHz(channel, tt.apChannel, tt.apBandwidthMhz); got != want {
+					t.Errorf("overlap5GHz(%d, %d, %d) = %v, want %v", channel, tt.apChannel, tt.apBandwidthMhz, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSignalWeight(t *testing.T) {
+	tests := []struct {
+		rssiDbm int32
+		want    float64
+	}{
+		{-30, 1},
+		{-40, 1},
+		{-70, 0.5},
+		{-94, 0.1},
+		{-100, 0.1},
+		{-110, 0.1},
+	}
+
+	for _, tt := range tests {
+		if got := signalWeight(tt.rssiDbm); !approxEqual(got, tt.want) {
+			t.Errorf("signalWeight(%d) = %v, want %v", tt.rssiDbm, got, tt.want)
+		}
+	}
+}
+
+func TestRecommendChannel(t *testing.T) {
+	ap := func(band dev.WiFiBand, channel, bandwidthMhz, rssiDbm int32) *dev.WiFiAccessPoint {
+		return &dev.WiFiAccessPoint{Band: band, Channel: channel, BandwidthMhz: bandwidthMhz, RssiDbm: rssiDbm}
+	}
+
+	tests := []struct {
+		name         string
+		accessPoints []*dev.WiFiAccessPoint
+		band         dev.WiFiBand
+		allowDFS     bool
+		// the first channels of the result, best first
+		wantFirst []int32
+		wantCount int
+		wantErr   bool
+	}{
+		{
+			name:      "empty 2.4 GHz prefers non-overlapping channels",
+			band:      dev.WiFiBand_WIFI_BAND_2_4_GHZ,
+			wantFirst: []int32{1, 6, 11, 2, 3},
+			wantCount: len(channels2_4GHz),
+		},
+		{
+			name: "busy 2.4 GHz channels pushed back",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 1, 20, -40),
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 6, 20, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_2_4_GHZ,
+			wantFirst: []int32{11},
+			wantCount: len(channels2_4GHz),
+		},
+		{
+			name: "weak access points weigh less",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 1, 20, -90),
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 6, 20, -40),
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 11, 20, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_2_4_GHZ,
+			wantFirst: []int32{1},
+			wantCount: len(channels2_4GHz),
+		},
+		{
+			name: "other bands and unknown channels ignored",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 1, 20, -40),
+				ap(dev.WiFiBand_WIFI_BAND_2_4_GHZ, 0, 20, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_2_4_GHZ,
+			wantFirst: []int32{1, 6, 11},
+			wantCount: len(channels2_4GHz),
+		},
+		{
+			name: "5 GHz avoids the whole 80 MHz block",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 40, 80, -40),
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 153, 40, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_5_GHZ,
+			wantFirst: []int32{157, 161, 165},
+			wantCount: len(channels5GHz),
+		},
+		{
+			name: "5 GHz without DFS",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 36, 20, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_5_GHZ,
+			wantFirst: []int32{40, 44},
+			wantCount: len(channels5GHz),
+		},
+		{
+			name: "5 GHz with DFS",
+			accessPoints: []*dev.WiFiAccessPoint{
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 36, 80, -40),
+				ap(dev.WiFiBand_WIFI_BAND_5_GHZ, 149, 80, -40),
+			},
+			band:      dev.WiFiBand_WIFI_BAND_5_GHZ,
+			allowDFS:  true,
+			wantFirst: []int32{52, 56},
+			wantCount: len(channels5GHz) + len(channels5GHzDFS),
+		},
+		{
+			name:    "6 GHz unsupported",
+			band:    dev.WiFiBand_WIFI_BAND_6_GHZ,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scores, err := RecommendChannel(tt.accessPoints, tt.band, tt.allowDFS)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RecommendChannel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if fields := violationFields(t, err, ErrUnsupportedChannelBand); !slices.Equal(fields, []string{"band"}) {
+					t.Errorf("violations on %v, want band", fields)
+				}
+				return
+			}
+
+			if len(scores) != tt.wantCount {
+				t.Fatalf("got %d channels, want %d", len(scores), tt.wantCount)
+			}
+			for i, channel := range tt.wantFirst {
+				if scores[i].Channel != channel {
+					t.Errorf("channel %d = %d, want %d", i, scores[i].Channel, channel)
+				}
+			}
+			for i := 1; i < len(scores); i++ {
+				if scores[i].Score < scores[i-1].Score {
+					t.Errorf("channel %d scores %v, better than channel %d before it with %v", scores[i].Channel, scores[i].Score, scores[i-1].Channel, scores[i-1].Score)
+				}
+			}
+			for _, score := range scores {
+				if score.Dfs != isDFSChannel(tt.band, score.Channel) {
+					t.Errorf("channel %d dfs = %v", score.Channel, score.Dfs)
+				}
+				if score.Dfs && !tt.allowDFS {
+					t.Errorf("DFS channel %d recommended without allowDFS", score.Channel)
+				}
+				if score.Frequency != channelToFrequency(tt.band, score.Channel) {
+					t.Errorf("channel %d frequency = %d", score.Channel, score.Frequency)
+				}
+			}
+		})
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	const epsilon = 1e-9
+	return a-b < epsilon && b-a < epsilon
+}
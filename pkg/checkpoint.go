@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// NMCheckpointCreateFlags values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_CHECKPOINT_CREATE_FLAG_NONE                   = 0x00
+	NM_CHECKPOINT_CREATE_FLAG_DESTROY_ALL            = 0x01
+	NM_CHECKPOINT_CREATE_FLAG_DELETE_NEW_CONNECTIONS = 0x02
+	NM_CHECKPOINT_CREATE_FLAG_DISCONNECT_NEW_DEVICES = 0x04
+)
+
+const (
+	defaultRollbackTimeout = 90 * time.Second
+	minRollbackTimeout     = 30 * time.Second
+	// rollbackMargin is kept between finishing the change (including the connectivity check) and the checkpoint's
+	// own timeout, so we get to commit or roll back before NetworkManager does
+	rollbackMargin = 5 * time.Second
+
+	connectivityCheckInterval = 2 * time.Second
+	connectivityCheckTimeout  = 5 * time.Second
+)
+
+var ErrInvalidRollbackOptions = errors.New("invalid rollback options")
+
+// RollbackError is returned when a change guarded by a checkpoint failed and the previous state was restored
+type RollbackError struct {
+	Err error
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v; previous network state restored", e.Err)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateRollbackOptions checks the rollback options of a request; nil options (no rollback) are valid
+func ValidateRollbackOptions(options *dev.WiFiRollbackOptions) error {
+	var v violations
+	validateRollbackOptions(&v, "rollback", options)
+
+	return v.err(ErrInvalidRollbackOptions)
+}
+
+func validateRollbackOptions(v *violations, field string, options *dev.WiFiRollbackOptions) {
+	if !options.GetEnabled() || options.TimeoutSeconds == 0 {
+		return
+	}
+
+	if timeout := time.Duration(options.TimeoutSeconds) * time.Second; timeout < minRollbackTimeout {
+		v.add(fieldPath(field, "timeout_seconds"), "must be at least %d, got %d", int(minRollbackTimeout.Seconds()), options.TimeoutSeconds)
+	}
+}
+
+// RollbackTimeout is how long a change guarded by options may take before it gets rolled back
+func RollbackTimeout(options *dev.WiFiRollbackOptions) time.Duration {
+	if options.GetTimeoutSeconds() == 0 {
+		return defaultRollbackTimeout
+	}
+
+	return time.Duration(options.TimeoutSeconds) * time.Second
+}
+
+// withRollback runs change with a NetworkManager checkpoint of devices in place when options are enabled. If change
+// fails, or the internet can't be reached through any of devices afterwards, the checkpoint is rolled back and a
+// *RollbackError returned. Otherwise the checkpoint is destroyed, which keeps the change.
+func withRollback(ctx context.Context, conn *dbus.Conn, devices []wifiDevice, options *dev.WiFiRollbackOptions, progress ProgressFunc, change func(ctx context.Context) error) error {
+	if !options.GetEnabled() {
+		return change(ctx)
+	}
+
+	devicePaths := make([]dbus.ObjectPath, 0, len(devices))
+	interfaceNames := make([]string, 0, len(devices))
+	for _, d := range devices {
+		devicePaths = append(devicePaths, d.path)
+		interfaceNames = append(interfaceNames, d.interfaceName)
+	}
+
+	timeout := RollbackTimeout(options)
+	checkpoint, err := createCheckpoint(ctx, conn, devicePaths, timeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created checkpoint %s, rolling back in %s unless the change works out", checkpoint, timeout)
+
+	changeCtx, cancel := context.WithTimeout(ctx, timeout-rollbackMargin)
+	defer cancel()
+
+	err = change(changeCtx)
+	if err == nil && !options.SkipConnectivityCheck {
+		progress.report(dev.WiFiOperationStep_WIFI_OPERATION_STEP_VERIFYING_INTERNET)
+		err = waitForConnectivity(changeCtx, interfaceNames)
+	}
+
+	// ctx may be done by now, and the checkpoint has to be resolved regardless
+	if err != nil {
+		log.Printf("Rolling back checkpoint %s: %v", checkpoint, err)
+		progress.report(dev.WiFiOperationStep_WIFI_OPERATION_STEP_ROLLING_BACK)
+		if rollbackErr := rollbackCheckpoint(context.Background(), conn, checkpoint); rollbackErr != nil {
+			// NetworkManager still rolls back on its own once the checkpoint times out
+			log.Printf("Failed to roll back checkpoint %s: %v", checkpoint, rollbackErr)
+			return err
+		}
+		return &RollbackError{Err: err}
+	}
+
+	if err := destroyCheckpoint(context.Background(), conn, checkpoint); err != nil {
+		return fmt.Errorf("failed to keep the change, it will be rolled back: %v", err)
+	}
+
+	return nil
+}
+
+func createCheckpoint(ctx context.Context, conn *dbus.Conn, devicePaths []dbus.ObjectPath, timeout time.Duration) (dbus.ObjectPath, error) {
+	flags := uint32(NM_CHECKPOINT_CREATE_FLAG_DELETE_NEW_CONNECTIONS | NM_CHECKPOINT_CREATE_FLAG_DISCONNECT_NEW_DEVICES)
+	call := nmConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.CheckpointCreate", 0, devicePaths, uint32(timeout.Seconds()), flags)
+	if call.Err != nil {
+		return "", fmt.Errorf("failed to create checkpoint: %v", call.Err)
+	}
+
+	var checkpoint dbus.ObjectPath
+	if err := call.Store(&checkpoint); err != nil {
+		return "", fmt.Errorf("failed to store checkpoint path: %v", err)
+	}
+
+	return checkpoint, nil
+}
+
+func rollbackCheckpoint(ctx context.Context, conn *dbus.Conn, checkpoint dbus.ObjectPath) error {
+	call := nmConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.CheckpointRollback", 0, checkpoint)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	// The result maps each device to an NMRollbackResult, 0 being success
+	results := map[string]uint32{}
+	if err := call.Store(&results); err != nil {
+		return err
+	}
+	for device, result := range results {
+		if result != 0 {
+			log.Printf("Rollback of %s failed with result %d", device, result)
+		}
+	}
+
+	return nil
+}
+
+func destroyCheckpoint(ctx context.Context, conn *dbus.Conn, checkpoint dbus.ObjectPath) error {
+	return nmConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.CheckpointDestroy", 0, checkpoint).Err
+}
+
+// waitForConnectivity repeats the internet connectivity check through interfaceNames until it passes through one of
+// them or ctx is done; without interfaceNames any route will do. Right after an activation, DNS and routes may take
+// a moment to settle.
+func waitForConnectivity(ctx context.Context, interfaceNames []string) error {
+	if len(interfaceNames) == 0 {
+		interfaceNames = []string{""}
+	}
+
+	ticker := time.NewTicker(connectivityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, interfaceName := range interfaceNames {
+			checkCtx, cancel := context.WithTimeout(ctx, connectivityCheckTimeout)
+			isConnected, err := checkInternetConnectivity(checkCtx, interfaceName)
+			cancel()
+			if err == nil && isConnected {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			reason := dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_NO_INTERNET
+			return connectFailureError(&dev.WiFiConnectFailure{
+				Reason:  reason,
+				Message: connectFailureMessages[reason],
+			})
+		case <-ticker.C:
+		}
+	}
+}
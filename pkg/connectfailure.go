@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// NMActiveConnectionStateReason values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_ACTIVE_CONNECTION_STATE_REASON_UNKNOWN               = 0
+	NM_ACTIVE_CONNECTION_STATE_REASON_NONE                  = 1
+	NM_ACTIVE_CONNECTION_STATE_REASON_USER_DISCONNECTED     = 2
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEVICE_DISCONNECTED   = 3
+	NM_ACTIVE_CONNECTION_STATE_REASON_SERVICE_STOPPED       = 4
+	NM_ACTIVE_CONNECTION_STATE_REASON_IP_CONFIG_INVALID     = 5
+	NM_ACTIVE_CONNECTION_STATE_REASON_CONNECT_TIMEOUT       = 6
+	NM_ACTIVE_CONNECTION_STATE_REASON_SERVICE_START_TIMEOUT = 7
+	NM_ACTIVE_CONNECTION_STATE_REASON_SERVICE_START_FAILED  = 8
+	NM_ACTIVE_CONNECTION_STATE_REASON_NO_SECRETS            = 9
+	NM_ACTIVE_CONNECTION_STATE_REASON_LOGIN_FAILED          = 10
+	NM_ACTIVE_CONNECTION_STATE_REASON_CONNECTION_REMOVED    = 11
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEPENDENCY_FAILED     = 12
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEVICE_REALIZE_FAILED = 13
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEVICE_REMOVED        = 14
+)
+
+// NMDeviceState values we care about
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_DEVICE_STATE_DISCONNECTED = 30
+	NM_DEVICE_STATE_PREPARE      = 40
+	NM_DEVICE_STATE_CONFIG       = 50
+	NM_DEVICE_STATE_NEED_AUTH    = 60
+	NM_DEVICE_STATE_IP_CONFIG    = 70
+	NM_DEVICE_STATE_IP_CHECK     = 80
+	NM_DEVICE_STATE_SECONDARIES  = 90
+	NM_DEVICE_STATE_ACTIVATED    = 100
+	NM_DEVICE_STATE_FAILED       = 120
+)
+
+// NMDeviceStateReason values we can attribute a failed Wi-Fi activation to
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_DEVICE_STATE_REASON_NONE                     = 0
+	NM_DEVICE_STATE_REASON_UNKNOWN                  = 1
+	NM_DEVICE_STATE_REASON_CONFIG_FAILED            = 4
+	NM_DEVICE_STATE_REASON_IP_CONFIG_UNAVAILABLE    = 5
+	NM_DEVICE_STATE_REASON_IP_CONFIG_EXPIRED        = 6
+	NM_DEVICE_STATE_REASON_NO_SECRETS               = 7
+	NM_DEVICE_STATE_REASON_SUPPLICANT_DISCONNECT    = 8
+	NM_DEVICE_STATE_REASON_SUPPLICANT_CONFIG_FAILED = 9
+	NM_DEVICE_STATE_REASON_SUPPLICANT_FAILED        = 10
+	NM_DEVICE_STATE_REASON_SUPPLICANT_TIMEOUT       = 11
+	NM_DEVICE_STATE_REASON_DHCP_START_FAILED        = 15
+	NM_DEVICE_STATE_REASON_DHCP_ERROR               = 16
+	NM_DEVICE_STATE_REASON_DHCP_FAILED              = 17
+	NM_DEVICE_STATE_REASON_REMOVED                  = 36
+	NM_DEVICE_STATE_REASON_CONNECTION_REMOVED       = 38
+	NM_DEVICE_STATE_REASON_USER_REQUESTED           = 39
+	NM_DEVICE_STATE_REASON_SSID_NOT_FOUND           = 53
+)
+
+var deviceStateReasonFailures = map[uint32]dev.WiFiConnectFailureReason{
+	NM_DEVICE_STATE_REASON_NO_SECRETS:               dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED,
+	NM_DEVICE_STATE_REASON_SUPPLICANT_DISCONNECT:    dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED,
+	NM_DEVICE_STATE_REASON_SUPPLICANT_CONFIG_FAILED: dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_FAILED,
+	NM_DEVICE_STATE_REASON_SUPPLICANT_FAILED:        dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_FAILED,
+	NM_DEVICE_STATE_REASON_SUPPLICANT_TIMEOUT:       dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_TIMEOUT,
+	NM_DEVICE_STATE_REASON_DHCP_START_FAILED:        dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DHCP_FAILED,
+	NM_DEVICE_STATE_REASON_DHCP_ERROR:               dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DHCP_FAILED,
+	NM_DEVICE_STATE_REASON_DHCP_FAILED:              dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DHCP_FAILED,
+	NM_DEVICE_STATE_REASON_CONFIG_FAILED:            dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED,
+	NM_DEVICE_STATE_REASON_IP_CONFIG_UNAVAILABLE:    dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED,
+	NM_DEVICE_STATE_REASON_IP_CONFIG_EXPIRED:        dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED,
+	NM_DEVICE_STATE_REASON_REMOVED:                  dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DEVICE_REMOVED,
+	NM_DEVICE_STATE_REASON_CONNECTION_REMOVED:       dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CONNECTION_REMOVED,
+	NM_DEVICE_STATE_REASON_USER_REQUESTED:           dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DISCONNECTED,
+	NM_DEVICE_STATE_REASON_SSID_NOT_FOUND:           dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SSID_NOT_FOUND,
+}
+
+var activeConnectionStateReasonFailures = map[uint32]dev.WiFiConnectFailureReason{
+	NM_ACTIVE_CONNECTION_STATE_REASON_USER_DISCONNECTED:     dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DISCONNECTED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_IP_CONFIG_INVALID:     dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_CONNECT_TIMEOUT:       dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_TIMEOUT,
+	NM_ACTIVE_CONNECTION_STATE_REASON_NO_SECRETS:            dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_LOGIN_FAILED:          dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_CONNECTION_REMOVED:    dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CONNECTION_REMOVED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEVICE_REALIZE_FAILED: dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DEVICE_REMOVED,
+	NM_ACTIVE_CONNECTION_STATE_REASON_DEVICE_REMOVED:        dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DEVICE_REMOVED,
+}
+
+var connectFailureMessages = map[dev.WiFiConnectFailureReason]string{
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_UNKNOWN:            "connection failed",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED:        "authentication failed, the password may be wrong",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SSID_NOT_FOUND:     "network not found",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_TIMEOUT: "timed out associating with the network",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_FAILED:  "wpa_supplicant failed",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DHCP_FAILED:        "failed to get an address over DHCP",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED:   "IP configuration failed",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_TIMEOUT:            "connection timeout",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DEVICE_REMOVED:     "Wi-Fi device went away",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CONNECTION_REMOVED: "connection profile was removed",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DISCONNECTED:       "connection was deactivated",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CANCELED:           "connection attempt canceled",
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_NO_INTERNET:        "connected, but the internet can't be reached",
+}
+
+var connectFailureCodes = map[dev.WiFiConnectFailureReason]connect.Code{
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_AUTH_FAILED:        connect.CodePermissionDenied,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SSID_NOT_FOUND:     connect.CodeNotFound,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_TIMEOUT: connect.CodeDeadlineExceeded,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_SUPPLICANT_FAILED:  connect.CodeInternal,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DHCP_FAILED:        connect.CodeUnavailable,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_IP_CONFIG_FAILED:   connect.CodeUnavailable,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_TIMEOUT:            connect.CodeDeadlineExceeded,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DEVICE_REMOVED:     connect.CodeAborted,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CONNECTION_REMOVED: connect.CodeAborted,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_DISCONNECTED:       connect.CodeAborted,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CANCELED:           connect.CodeCanceled,
+	dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_NO_INTERNET:        connect.CodeUnavailable,
+}
+
+// connectFailure decodes why an activation failed. The device's reason is the more specific one (the active
+// connection mostly just says "device disconnected"), so it wins when it's known.
+func connectFailure(activeConnectionReason, deviceReason uint32) *dev.WiFiConnectFailure {
+	reason, ok := deviceStateReasonFailures[deviceReason]
+	if !ok {
+		reason = activeConnectionStateReasonFailures[activeConnectionReason]
+	}
+
+	return &dev.WiFiConnectFailure{
+		Reason:                      reason,
+		Message:                     connectFailureMessages[reason],
+		ActiveConnectionStateReason: activeConnectionReason,
+		DeviceStateReason:           deviceReason,
+	}
+}
+
+// contextConnectFailure describes an activation abandoned because ctx is done
+func contextConnectFailure(ctx context.Context, deviceReason uint32) *dev.WiFiConnectFailure {
+	reason := dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_TIMEOUT
+	if errors.Is(ctx.Err(), context.Canceled) {
+		reason = dev.WiFiConnectFailureReason_WIFI_CONNECT_FAILURE_CANCELED
+	}
+
+	return &dev.WiFiConnectFailure{
+		Reason:            reason,
+		Message:           connectFailureMessages[reason],
+		DeviceStateReason: deviceReason,
+	}
+}
+
+// connectFailureError turns failure into a Connect error with a matching code and failure attached as detail
+func connectFailureError(failure *dev.WiFiConnectFailure) error {
+	code, ok := connectFailureCodes[failure.Reason]
+	if !ok {
+		code = connect.CodeUnknown
+	}
+
+	connectErr := connect.NewError(code, errors.New(failure.Message))
+	if detail, err := connect.NewErrorDetail(failure); err == nil {
+		connectErr.AddDetail(detail)
+	}
+
+	return connectErr
+}
+
+// connectFailureFromError digs the WiFiConnectFailure detail out of an error made by connectFailureError
+func connectFailureFromError(err error) *dev.WiFiConnectFailure {
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) {
+		return nil
+	}
+
+	for _, detail := range connectErr.Details() {
+		value, err := detail.Value()
+		if err != nil {
+			continue
+		}
+		if failure, ok := value.(*dev.WiFiConnectFailure); ok {
+			return failure
+		}
+	}
+
+	return nil
+}
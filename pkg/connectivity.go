@@ -2,7 +2,9 @@ package pkg
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"syscall"
 	"time"
 
 	"connectrpc.com/connect"
@@ -28,34 +30,55 @@ func (s *ConnectivityServer) InternetConnectivityCheck(baseCtx context.Context,
 	ctx, cancel := context.WithTimeout(baseCtx, time.Duration(timeoutMs)*time.Millisecond)
 	defer cancel()
 
-	targetURL := "https://www.google.com/generate_204"
-
-	httpClient := &http.Client{
-		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	isConnected, err := checkInternetConnectivity(ctx, "")
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", targetURL, nil)
+	return &connect.Response[dev.InternetConnectivityCheckResponse]{
+		Msg: &dev.InternetConnectivityCheckResponse{
+			IsConnected: isConnected,
+		},
+	}, nil
+}
+
+const connectivityCheckURL = "https://www.google.com/generate_204"
+
+// checkInternetConnectivity reports whether the connectivity check URL answers with a 204, within ctx's deadline.
+// With interfaceName the check goes out over that interface, whichever route is the default; a gateway with
+// Ethernet or LTE would otherwise pass it for a Wi-Fi network that has no internet.
+func checkInternetConnectivity(ctx context.Context, interfaceName string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", connectivityCheckURL, nil)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	resp, err := httpClient.Do(req)
+	client := http.DefaultClient
+	if interfaceName != "" {
+		client = interfaceHTTPClient(interfaceName)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		return &connect.Response[dev.InternetConnectivityCheckResponse]{
-			Msg: &dev.InternetConnectivityCheckResponse{
-				IsConnected: false,
-			},
-		}, nil
+	return resp.StatusCode == http.StatusNoContent, nil
+}
+
+// interfaceHTTPClient returns a client that connects through interfaceName only. Names are still resolved by the
+// system resolver, which may well listen on loopback (e.g. systemd-resolved), so it can't be bound as well.
+func interfaceHTTPClient(interfaceName string) *http.Client {
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return bindToInterface(c, interfaceName)
+		},
 	}
 
-	return &connect.Response[dev.InternetConnectivityCheckResponse]{
-		Msg: &dev.InternetConnectivityCheckResponse{
-			IsConnected: true,
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
 		},
-	}, nil
+	}
 }
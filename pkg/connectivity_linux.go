@@ -0,0 +1,22 @@
+package pkg
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToInterface binds the socket c to interfaceName (SO_BINDTODEVICE), so its traffic leaves through that
+// interface regardless of the routing table
+func bindToInterface(c syscall.RawConn, interfaceName string) error {
+	var bindErr error
+	if err := c.Control(func(fd uintptr) {
+		bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName)
+	}); err != nil {
+		return err
+	}
+	if bindErr != nil {
+		return fmt.Errorf("failed to bind to %s: %v", interfaceName, bindErr)
+	}
+
+	return nil
+}
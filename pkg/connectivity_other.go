@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pkg
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToInterface is only supported on Linux, where NetworkManager runs
+func bindToInterface(c syscall.RawConn, interfaceName string) error {
+	return errors.New("binding to a network interface is only supported on Linux")
+}
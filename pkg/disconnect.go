@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+var ErrNoMatchingConnection = errors.New("no matching WiFi connection found")
+
+// DisconnectPlan is what a Disconnect request matched, resolved before anything changes so that a request matching
+// nothing can be turned down right away
+type DisconnectPlan struct {
+	request *dev.WiFiDisconnectRequest
+	devices []wifiDevice
+	active  []disconnectTarget
+	// inactive are the profiles to forget that aren't active on any of devices
+	inactive []savedProfile
+}
+
+// disconnectTarget is an active connection to deactivate
+type disconnectTarget struct {
+	activeConnPath dbus.ObjectPath
+	connPath       dbus.ObjectPath
+	uuid           string
+	ssid           string
+	interfaceName  string
+}
+
+// PlanDisconnect resolves the devices and connections request applies to: the active Wi-Fi connection for its SSID,
+// or the active client connections when the SSID is empty; a hotspot only matches when named by its SSID or
+// interface. With forget, saved profiles for the SSID that aren't active match as well. Returns
+// ErrNoMatchingConnection when nothing matches.
+func PlanDisconnect(ctx context.Context, conn *dbus.Conn, request *dev.WiFiDisconnectRequest) (*DisconnectPlan, error) {
+	if err := ValidateRollbackOptions(request.Rollback); err != nil {
+		return nil, err
+	}
+
+	devices, err := findWifiDevices(ctx, conn, request.NetworkInterface)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoWifiDevice
+	}
+
+	plan := &DisconnectPlan{
+		request: request,
+		devices: devices,
+	}
+	active := map[dbus.ObjectPath]bool{}
+
+	for _, d := range devices {
+		activeConnProp, err := d.object(conn).GetProperty("org.freedesktop.NetworkManager.Device.ActiveConnection")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get active connection: %v", err)
+		}
+
+		activeConnPath, _ := activeConnProp.Value().(dbus.ObjectPath)
+		if activeConnPath == "" || activeConnPath == "/" {
+			continue
+		}
+
+		connProp, err := conn.Object(serviceName, activeConnPath).GetProperty("org.freedesktop.NetworkManager.Connection.Active.Connection")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get connection path: %v", err)
+		}
+		connPath := connProp.Value().(dbus.ObjectPath)
+
+		settingsInfo, err := connectionSettings(ctx, conn, connPath)
+		if err != nil {
+			return nil, err
+		}
+
+		ssid, ok := settingsSSID(settingsInfo)
+		if !ok {
+			continue
+		}
+		if request.SSID != "" && ssid != request.SSID {
+			continue
+		}
+		// "The current connection" is the one the device is a client of; a hotspot is only taken down when asked for
+		// by SSID or interface
+		if request.SSID == "" && request.NetworkInterface == "" && isHotspotProfile(settingsInfo) {
+			continue
+		}
+
+		plan.active = append(plan.active, disconnectTarget{
+			activeConnPath: activeConnPath,
+			connPath:       connPath,
+			uuid:           parseSavedProfile(connPath, settingsInfo).uuid,
+			ssid:           ssid,
+			interfaceName:  d.interfaceName,
+		})
+		active[connPath] = true
+	}
+
+	// Forgetting a specific SSID also covers profiles that weren't active
+	if request.Forget && request.SSID != "" {
+		connections, err := listConnections(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range connections {
+			if active[c] {
+				continue
+			}
+
+			settingsInfo, err := connectionSettings(ctx, conn, c)
+			if err != nil {
+				return nil, err
+			}
+
+			if ssid, ok := settingsSSID(settingsInfo); !ok || ssid != request.SSID {
+				continue
+			}
+			if !profileMatchesInterface(settingsInfo, request.NetworkInterface) {
+				continue
+			}
+
+			plan.inactive = append(plan.inactive, parseSavedProfile(c, settingsInfo))
+		}
+	}
+
+	if len(plan.active) == 0 && len(plan.inactive) == 0 {
+		return nil, ErrNoMatchingConnection
+	}
+
+	return plan, nil
+}
+
+// DisconnectWiFi deactivates the connections plan matched and, with forget, deletes their saved profiles. With
+// rollback enabled in the request, the disconnect is undone unless the device can still reach the internet over
+// Wi-Fi afterwards, e.g. through another saved network.
+func DisconnectWiFi(ctx context.Context, conn *dbus.Conn, plan *DisconnectPlan, progress ProgressFunc) (*dev.WiFiDisconnectResponse, error) {
+	var response *dev.WiFiDisconnectResponse
+	err := withRollback(ctx, conn, plan.devices, plan.request.Rollback, progress, func(ctx context.Context) error {
+		progress.report(dev.WiFiOperationStep_WIFI_OPERATION_STEP_DISCONNECTING)
+		var err error
+		response, err = disconnectWiFi(ctx, conn, plan)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func disconnectWiFi(ctx context.Context, conn *dbus.Conn, plan *DisconnectPlan) (*dev.WiFiDisconnectResponse, error) {
+	nm := nmConn(conn)
+	response := &dev.WiFiDisconnectResponse{}
+
+	for _, target := range plan.active {
+		log.Printf("Deactivating connection %s (%s) on %s", target.ssid, target.activeConnPath, target.interfaceName)
+		if err := nm.CallWithContext(ctx, "org.freedesktop.NetworkManager.DeactivateConnection", 0, target.activeConnPath).Err; err != nil {
+			return nil, fmt.Errorf("failed to deactivate connection: %v", err)
+		}
+		response.DisconnectedSsids = append(response.DisconnectedSsids, target.ssid)
+
+		if plan.request.Forget {
+			if err := deleteConnection(ctx, conn, target.connPath, target.uuid); err != nil {
+				return nil, err
+			}
+			response.ForgottenProfiles++
+		}
+	}
+
+	for _, profile := range plan.inactive {
+		if err := deleteConnection(ctx, conn, profile.path, profile.uuid); err != nil {
+			return nil, err
+		}
+		response.ForgottenProfiles++
+	}
+
+	return response, nil
+}
+
+// isHotspotProfile reports whether a profile serves an access point rather than joining one
+func isHotspotProfile(settingsInfo map[string]map[string]dbus.Variant) bool {
+	mode, _ := settingsInfo["802-11-wireless"]["mode"].Value().(string)
+	return mode == "ap"
+}
+
+// profileMatchesInterface reports whether a profile could be used on networkInterfaceName; profiles without an
+// interface binding match any interface
+func profileMatchesInterface(settingsInfo map[string]map[string]dbus.Variant, networkInterfaceName string) bool {
+	if networkInterfaceName == "" {
+		return true
+	}
+
+	boundInterface, _ := settingsInfo["connection"]["interface-name"].Value().(string)
+	return boundInterface == "" || boundInterface == networkInterfaceName
+}
+
+// deleteConnection deletes the profile at connPath, and the certificate files kept for it by its uuid
+func deleteConnection(ctx context.Context, conn *dbus.Conn, connPath dbus.ObjectPath, uuid string) error {
+	log.Printf("Deleting connection profile: %s", connPath)
+	if err := conn.Object(serviceName, connPath).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.Delete", 0).Err; err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	removeCertificateFiles(uuid)
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// CertificateDir is where EAP certificates and keys are written, since NM only takes them as files
+var CertificateDir = "/var/lib/iotnetlab/certs"
+
+var ErrInvalidEAPConfig = errors.New("invalid EAP configuration")
+
+var eapMethodNames = map[dev.WiFiEAPMethod]string{
+	dev.WiFiEAPMethod_WIFI_EAP_PEAP: "peap",
+	dev.WiFiEAPMethod_WIFI_EAP_TLS:  "tls",
+	dev.WiFiEAPMethod_WIFI_EAP_TTLS: "ttls",
+	dev.WiFiEAPMethod_WIFI_EAP_PWD:  "pwd",
+	dev.WiFiEAPMethod_WIFI_EAP_SIM:  "sim",
+	dev.WiFiEAPMethod_WIFI_EAP_AKA:  "aka",
+}
+
+// eapPhase2AuthNames lists the inner authentications each tunneled method supports
+var eapPhase2AuthNames = map[dev.WiFiEAPMethod]map[dev.WiFiEAPPhase2Auth]string{
+	dev.WiFiEAPMethod_WIFI_EAP_PEAP: {
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_DEFAULT:  "mschapv2",
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_MSCHAPV2: "mschapv2",
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_GTC:      "gtc",
+	},
+	dev.WiFiEAPMethod_WIFI_EAP_TTLS: {
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_DEFAULT:  "mschapv2",
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_MSCHAPV2: "mschapv2",
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_PAP:      "pap",
+		dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_GTC:      "gtc",
+	},
+}
+
+// ValidateEAPConfig checks that config is complete and consistent for its method, and that its certificates and
+// key can be used
+func ValidateEAPConfig(config *dev.WiFiEAPConfig) error {
+	var v violations
+	validateEAPConfig(&v, "eap_config", config, time.Now())
+
+	return v.err(ErrInvalidEAPConfig)
+}
+
+// validateEAPConfig adds the problems of config to v, under field. Certificates have to be valid at now.
+func validateEAPConfig(v *violations, field string, config *dev.WiFiEAPConfig, now time.Time) {
+	if config == nil {
+		v.add(field, "eap_config is required")
+		return
+	}
+	methodName, ok := eapMethodNames[config.Method]
+	if !ok {
+		v.add(fieldPath(field, "method"), "unknown method %d", config.Method)
+		return
+	}
+
+	tunneled := config.Method == dev.WiFiEAPMethod_WIFI_EAP_PEAP || config.Method == dev.WiFiEAPMethod_WIFI_EAP_TTLS
+	validatesServer := tunneled || config.Method == dev.WiFiEAPMethod_WIFI_EAP_TLS
+
+	switch config.Method {
+	case dev.WiFiEAPMethod_WIFI_EAP_PEAP, dev.WiFiEAPMethod_WIFI_EAP_TTLS, dev.WiFiEAPMethod_WIFI_EAP_PWD:
+		if config.Identity == "" {
+			v.add(fieldPath(field, "identity"), "%s needs an identity", methodName)
+		}
+		if config.Password == "" {
+			v.add(fieldPath(field, "password"), "%s needs a password", methodName)
+		}
+	case dev.WiFiEAPMethod_WIFI_EAP_TLS:
+		if config.Identity == "" {
+			v.add(fieldPath(field, "identity"), "tls needs an identity")
+		}
+		if config.ClientCertificate == "" {
+			v.add(fieldPath(field, "client_certificate"), "tls needs a client certificate")
+		}
+		if config.PrivateKey == "" {
+			v.add(fieldPath(field, "private_key"), "tls needs a private key")
+		}
+		if config.Password != "" {
+			v.add(fieldPath(field, "password"), "tls doesn't use a password; a password for the private key goes in private_key_password")
+		}
+	case dev.WiFiEAPMethod_WIFI_EAP_SIM, dev.WiFiEAPMethod_WIFI_EAP_AKA:
+		if config.Password != "" {
+			v.add(fieldPath(field, "password"), "%s authenticates with the SIM card and doesn't use a password", methodName)
+		}
+	}
+
+	if config.Method != dev.WiFiEAPMethod_WIFI_EAP_TLS {
+		for _, f := range []struct {
+			name  string
+			isSet bool
+		}{
+			{"client_certificate", config.ClientCertificate != ""},
+			{"private_key", config.PrivateKey != ""},
+			{"private_key_password", config.PrivateKeyPassword != ""},
+		} {
+			if f.isSet {
+				v.add(fieldPath(field, f.name), "client certificates and private keys are only used with tls")
+			}
+		}
+	} else if config.PrivateKeyPassword != "" && config.PrivateKey == "" {
+		v.add(fieldPath(field, "private_key_password"), "private_key_password without a private_key")
+	}
+
+	if tunneled {
+		if _, ok := eapPhase2AuthNames[config.Method][config.Phase2Auth]; !ok {
+			v.add(fieldPath(field, "phase2_auth"), "%s doesn't support phase 2 authentication %s", methodName, config.Phase2Auth)
+		}
+	} else if config.Phase2Auth != dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_DEFAULT {
+		v.add(fieldPath(field, "phase2_auth"), "phase 2 authentication only applies to peap and ttls")
+	}
+
+	if !validatesServer {
+		for _, f := range []struct {
+			name  string
+			isSet bool
+		}{
+			{"ca_certificate", config.CaCertificate != ""},
+			{"use_system_ca_certs", config.UseSystemCaCerts},
+			{"domain_suffix_match", config.DomainSuffixMatch != ""},
+			{"altsubject_matches", len(config.AltsubjectMatches) > 0},
+		} {
+			if f.isSet {
+				v.add(fieldPath(field, f.name), "%s doesn't validate a server certificate", methodName)
+			}
+		}
+	}
+	if config.CaCertificate != "" && config.UseSystemCaCerts {
+		v.add(fieldPath(field, "use_system_ca_certs"), "use either ca_certificate or use_system_ca_certs, not both")
+	}
+
+	if config.CaCertificate != "" {
+		validateCertificates(v, fieldPath(field, "ca_certificate"), config.CaCertificate, now)
+	}
+	var clientCert *x509.Certificate
+	if config.ClientCertificate != "" {
+		if certs := validateCertificates(v, fieldPath(field, "client_certificate"), config.ClientCertificate, now); len(certs) > 0 {
+			clientCert = certs[0]
+		}
+	}
+	if config.PrivateKey != "" {
+		validatePrivateKey(v, fieldPath(field, "private_key"), config.PrivateKey, config.PrivateKeyPassword != "", clientCert)
+	}
+}
+
+// eapSettings builds the NM "802-1x" setting for a config that passed ValidateEAPConfig, writing certificates and
+// keys to the certificate directory of the profile uuid along the way. Whatever the directory held before is
+// replaced, so a certificate an updated profile no longer uses doesn't stay behind.
+func eapSettings(config *dev.WiFiEAPConfig, uuid string) (map[string]dbus.Variant, error) {
+	settings := map[string]dbus.Variant{
+		"eap": dbus.MakeVariant([]string{eapMethodNames[config.Method]}),
+	}
+
+	if config.Identity != "" {
+		settings["identity"] = dbus.MakeVariant(config.Identity)
+	}
+	if config.AnonymousIdentity != "" {
+		settings["anonymous-identity"] = dbus.MakeVariant(config.AnonymousIdentity)
+	}
+	if config.Password != "" {
+		settings["password"] = dbus.MakeVariant(config.Password)
+	}
+	if phase2Auth, ok := eapPhase2AuthNames[config.Method][config.Phase2Auth]; ok {
+		settings["phase2-auth"] = dbus.MakeVariant(phase2Auth)
+	}
+
+	dir, err := profileCertificateDir(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear certificate directory: %v", err)
+	}
+	for key, contents := range map[string]string{
+		"ca-cert":     config.CaCertificate,
+		"client-cert": config.ClientCertificate,
+		"private-key": config.PrivateKey,
+	} {
+		if contents == "" {
+			continue
+		}
+		path, err := writeCertificateFile(dir, key, certificatePEM(contents, key == "private-key"))
+		if err != nil {
+			return nil, err
+		}
+		settings[key] = dbus.MakeVariant(certificatePathBlob(path))
+	}
+	if config.PrivateKeyPassword != "" {
+		settings["private-key-password"] = dbus.MakeVariant(config.PrivateKeyPassword)
+	}
+
+	if config.UseSystemCaCerts {
+		settings["system-ca-certs"] = dbus.MakeVariant(true)
+	}
+	if config.DomainSuffixMatch != "" {
+		settings["domain-suffix-match"] = dbus.MakeVariant(config.DomainSuffixMatch)
+	}
+	if len(config.AltsubjectMatches) > 0 {
+		settings["altsubject-matches"] = dbus.MakeVariant(config.AltsubjectMatches)
+	}
+
+	return settings, nil
+}
+
+// profileCertificateDir is where the certificates and keys of the profile uuid are kept, so they can go with it
+func profileCertificateDir(uuid string) (string, error) {
+	if uuid == "" || uuid == "." || uuid == ".." || strings.ContainsAny(uuid, `/\`) {
+		return "", fmt.Errorf("invalid connection UUID %q", uuid)
+	}
+
+	return filepath.Join(CertificateDir, uuid), nil
+}
+
+// writeCertificateFile stores PEM contents in dir as name.pem and returns the file's path
+func writeCertificateFile(dir string, name string, contents string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	path := filepath.Join(dir, name+".pem")
+	if !strings.HasSuffix(contents, "\n") {
+		contents += "\n"
+	}
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		return "", fmt.Errorf("failed to write certificate: %v", err)
+	}
+
+	return path, nil
+}
+
+// removeCertificateFiles deletes the certificates and keys written for the profile uuid. It's called once the
+// profile is gone (or never made it), so errors are only logged.
+func removeCertificateFiles(uuid string) {
+	dir, err := profileCertificateDir(uuid)
+	if err != nil {
+		return
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to delete certificates of connection %s: %v", uuid, err)
+	}
+}
+
+// certificatePathBlob is how NM takes a certificate or key by path: "file://" and the path, NUL terminated
+func certificatePathBlob(path string) []byte {
+	return append([]byte("file://"+path), 0)
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// testCertificate is a self-signed certificate valid from notBefore to notAfter, and its private key, both PEM
+func testCertificate(t *testing.T, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "iotnetlab test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestValidateEAPConfig(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert, key := testCertificate(t, now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	_, otherKey := testCertificate(t, now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	expiredCert, _ := testCertificate(t, now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0))
+	futureCert, _ := testCertificate(t, now.AddDate(1, 0, 0), now.AddDate(2, 0, 0))
+	certDER, _ := pem.Decode([]byte(cert))
+	encryptedKey := string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("not really")}))
+
+	peap := func() *dev.WiFiEAPConfig {
+		return &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_PEAP, Identity: "user", Password: "secret"}
+	}
+	tls := func() *dev.WiFiEAPConfig {
+		return &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_TLS, Identity: "device", ClientCertificate: cert, PrivateKey: key}
+	}
+
+	tests := []struct {
+		name   string
+		config *dev.WiFiEAPConfig
+		// fields with violations, sorted
+		want []string
+	}{
+		{"missing", nil, []string{"eap_config"}},
+		{"unknown method", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod(99)}, []string{"eap_config.method"}},
+
+		{"peap", peap(), nil},
+		{"peap with a CA certificate and domain", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate, c.DomainSuffixMatch = cert, "example.com"
+			return c
+		}(), nil},
+		{"peap with system CA certificates", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.UseSystemCaCerts = true
+			return c
+		}(), nil},
+		{"peap with GTC", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.Phase2Auth = dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_GTC
+			return c
+		}(), nil},
+		{"peap without identity or password", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_PEAP}, []string{"eap_config.identity", "eap_config.password"}},
+		{"peap with PAP", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.Phase2Auth = dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_PAP
+			return c
+		}(), []string{"eap_config.phase2_auth"}},
+		{"peap with a client certificate", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.ClientCertificate, c.PrivateKey = cert, key
+			return c
+		}(), []string{"eap_config.client_certificate", "eap_config.private_key"}},
+		{"both CA certificate options", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate, c.UseSystemCaCerts = cert, true
+			return c
+		}(), []string{"eap_config.use_system_ca_certs"}},
+		{"expired CA certificate", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate = expiredCert
+			return c
+		}(), []string{"eap_config.ca_certificate"}},
+		{"CA certificate not valid yet", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate = futureCert
+			return c
+		}(), []string{"eap_config.ca_certificate"}},
+		{"CA bundle with an expired certificate", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate = cert + expiredCert
+			return c
+		}(), []string{"eap_config.ca_certificate"}},
+		{"CA certificate that isn't one", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate = key
+			return c
+		}(), []string{"eap_config.ca_certificate"}},
+		{"base64 DER CA certificate", func() *dev.WiFiEAPConfig {
+			c := peap()
+			c.CaCertificate = base64.StdEncoding.EncodeToString(certDER.Bytes)
+			return c
+		}(), nil},
+
+		{"ttls with PAP", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_TTLS, Identity: "user", Password: "secret", Phase2Auth: dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_PAP}, nil},
+
+		{"tls", tls(), nil},
+		{"tls without a certificate or key", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_TLS, Identity: "device"}, []string{"eap_config.client_certificate", "eap_config.private_key"}},
+		{"tls with a password", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.Password = "secret"
+			return c
+		}(), []string{"eap_config.password"}},
+		{"tls with phase 2 authentication", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.Phase2Auth = dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_MSCHAPV2
+			return c
+		}(), []string{"eap_config.phase2_auth"}},
+		{"tls with someone else's key", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.PrivateKey = otherKey
+			return c
+		}(), []string{"eap_config.private_key"}},
+		{"tls with an encrypted key", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.PrivateKey, c.PrivateKeyPassword = encryptedKey, "secret"
+			return c
+		}(), nil},
+		{"tls with an encrypted key but no password", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.PrivateKey = encryptedKey
+			return c
+		}(), []string{"eap_config.private_key"}},
+		{"tls with a key password but no key", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.PrivateKey, c.PrivateKeyPassword = "", "secret"
+			return c
+		}(), []string{"eap_config.private_key", "eap_config.private_key_password"}},
+		{"tls with an expired client certificate", func() *dev.WiFiEAPConfig {
+			c := tls()
+			c.ClientCertificate = expiredCert
+			return c
+		}(), []string{"eap_config.client_certificate", "eap_config.private_key"}},
+
+		{"pwd", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_PWD, Identity: "user", Password: "secret"}, nil},
+		{"pwd with a CA certificate", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_PWD, Identity: "user", Password: "secret", CaCertificate: cert}, []string{"eap_config.ca_certificate"}},
+
+		{"sim", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_SIM}, nil},
+		{"aka with a password", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_AKA, Password: "secret"}, []string{"eap_config.password"}},
+		{"sim with server validation", &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_SIM, UseSystemCaCerts: true, AltsubjectMatches: []string{"DNS:radius.example.com"}}, []string{"eap_config.altsubject_matches", "eap_config.use_system_ca_certs"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v violations
+			validateEAPConfig(&v, "eap_config", tt.config, now)
+			fields := violationFields(t, v.err(ErrInvalidEAPConfig), ErrInvalidEAPConfig)
+			if !slices.Equal(fields, tt.want) {
+				t.Errorf("violations for %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestEAPSettingsCertificateFiles(t *testing.T) {
+	certificateDir := CertificateDir
+	CertificateDir = t.TempDir()
+	t.Cleanup(func() { CertificateDir = certificateDir })
+
+	now := time.Now()
+	cert, key := testCertificate(t, now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	const uuid = "5b1e1f6c-5ad4-4c4f-9a39-2a3f7c6a0c11"
+	dir := filepath.Join(CertificateDir, uuid)
+
+	files := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	tlsConfig := &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_TLS, Identity: "device", CaCertificate: cert, ClientCertificate: cert, PrivateKey: key}
+	settings, err := eapSettings(tlsConfig, uuid)
+	if err != nil {
+		t.Fatalf("eapSettings() error = %v", err)
+	}
+	if got, want := files(), []string{"ca-cert.pem", "client-cert.pem", "private-key.pem"}; !slices.Equal(got, want) {
+		t.Errorf("certificate files = %v, want %v", got, want)
+	}
+	if got, want := string(settings["ca-cert"].Value().([]byte)), "file://"+filepath.Join(dir, "ca-cert.pem")+"\x00"; got != want {
+		t.Errorf("ca-cert = %q, want %q", got, want)
+	}
+
+	// An update without the client certificate doesn't leave it behind
+	peapConfig := &dev.WiFiEAPConfig{Method: dev.WiFiEAPMethod_WIFI_EAP_PEAP, Identity: "user", Password: "secret", CaCertificate: cert}
+	if _, err := eapSettings(peapConfig, uuid); err != nil {
+		t.Fatalf("eapSettings() error = %v", err)
+	}
+	if got, want := files(), []string{"ca-cert.pem"}; !slices.Equal(got, want) {
+		t.Errorf("certificate files after update = %v, want %v", got, want)
+	}
+
+	removeCertificateFiles(uuid)
+	if got := files(); len(got) != 0 {
+		t.Errorf("certificate files after removal = %v, want none", got)
+	}
+
+	for _, uuid := range []string{"", ".", "..", "../certs", "a/b"} {
+		if _, err := eapSettings(peapConfig, uuid); err == nil {
+			t.Errorf("eapSettings() with UUID %q succeeded, want an error", uuid)
+		}
+	}
+}
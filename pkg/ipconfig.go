@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// ErrInvalidIPConfig is returned when the IP configuration of a connect request doesn't make sense
+var ErrInvalidIPConfig = errors.New("invalid IP configuration")
+
+var ipMethodNames = map[dev.WiFiIPMethod]string{
+	dev.WiFiIPMethod_WIFI_IP_METHOD_AUTO:       "auto",
+	dev.WiFiIPMethod_WIFI_IP_METHOD_MANUAL:     "manual",
+	dev.WiFiIPMethod_WIFI_IP_METHOD_LINK_LOCAL: "link-local",
+	dev.WiFiIPMethod_WIFI_IP_METHOD_DISABLED:   "disabled",
+}
+
+// ValidateIPConfig checks config for the "ipv4" or "ipv6" address family. A nil config is valid.
+func ValidateIPConfig(family string, config *dev.WiFiIPConfig) error {
+	var v violations
+	validateIPConfig(&v, family, family, config)
+
+	return v.err(ErrInvalidIPConfig)
+}
+
+// validateIPConfig adds the problems of config for family to v, under field
+func validateIPConfig(v *violations, field string, family string, config *dev.WiFiIPConfig) {
+	if config == nil {
+		return
+	}
+
+	matchesFamily := func(addr netip.Addr) bool {
+		if family == "ipv4" {
+			return addr.Is4()
+		}
+		return addr.Is6() && !addr.Is4In6()
+	}
+
+	if _, ok := ipMethodNames[config.Method]; !ok {
+		v.add(fieldPath(field, "method"), "unknown method %d", config.Method)
+	}
+
+	manual := config.Method == dev.WiFiIPMethod_WIFI_IP_METHOD_MANUAL
+	if manual && len(config.Addresses) == 0 {
+		v.add(fieldPath(field, "addresses"), "the manual method needs at least one address")
+	}
+	if !manual && len(config.Addresses) > 0 {
+		v.add(fieldPath(field, "addresses"), "addresses are only allowed with the manual method")
+	}
+	if !manual && config.Gateway != "" {
+		v.add(fieldPath(field, "gateway"), "a gateway is only allowed with the manual method")
+	}
+	if config.Method == dev.WiFiIPMethod_WIFI_IP_METHOD_DISABLED &&
+		(len(config.DnsServers) > 0 || len(config.DnsSearch) > 0 || len(config.Routes) > 0 || config.IgnoreAutoDns) {
+		v.add(fieldPath(field, "method"), "DNS and routes can't be set when the address family is disabled")
+	}
+
+	for i, address := range config.Addresses {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil || !matchesFamily(prefix.Addr()) {
+			v.add(fmt.Sprintf("%s.addresses[%d]", field, i), "%q is not an %s address in CIDR notation", address, family)
+		}
+	}
+	if config.Gateway != "" {
+		gateway, err := netip.ParseAddr(config.Gateway)
+		if err != nil || !matchesFamily(gateway) {
+			v.add(fieldPath(field, "gateway"), "%q is not an %s address", config.Gateway, family)
+		}
+	}
+	for i, server := range config.DnsServers {
+		addr, err := netip.ParseAddr(server)
+		if err != nil || !matchesFamily(addr) {
+			v.add(fmt.Sprintf("%s.dns_servers[%d]", field, i), "%q is not an %s address", server, family)
+		}
+	}
+	for i, domain := range config.DnsSearch {
+		if domain == "" {
+			v.add(fmt.Sprintf("%s.dns_search[%d]", field, i), "empty DNS search domain")
+		}
+	}
+	for i, route := range config.Routes {
+		destination, err := netip.ParsePrefix(route.Destination)
+		if err != nil || !matchesFamily(destination.Addr()) {
+			v.add(fmt.Sprintf("%s.routes[%d].destination", field, i), "%q is not an %s network in CIDR notation", route.Destination, family)
+		}
+		if route.NextHop != "" {
+			nextHop, err := netip.ParseAddr(route.NextHop)
+			if err != nil || !matchesFamily(nextHop) {
+				v.add(fmt.Sprintf("%s.routes[%d].next_hop", field, i), "%q is not an %s address", route.NextHop, family)
+			}
+		}
+	}
+}
+
+// ipSettings builds the NM "ipv4"/"ipv6" setting for a config that passed ValidateIPConfig. A nil config means
+// automatic configuration.
+func ipSettings(family string, config *dev.WiFiIPConfig) map[string]dbus.Variant {
+	if config == nil {
+		config = &dev.WiFiIPConfig{}
+	}
+
+	settings := map[string]dbus.Variant{
+		"method": dbus.MakeVariant(ipMethodNames[config.Method]),
+	}
+
+	if len(config.Addresses) > 0 {
+		addressData := []map[string]dbus.Variant{}
+		for _, address := range config.Addresses {
+			prefix := netip.MustParsePrefix(address)
+			addressData = append(addressData, map[string]dbus.Variant{
+				"address": dbus.MakeVariant(prefix.Addr().String()),
+				"prefix":  dbus.MakeVariant(uint32(prefix.Bits())),
+			})
+		}
+		settings["address-data"] = dbus.MakeVariant(addressData)
+	}
+	if config.Gateway != "" {
+		settings["gateway"] = dbus.MakeVariant(config.Gateway)
+	}
+
+	if len(config.DnsServers) > 0 {
+		// ipv4.dns is a list of addresses as uint32 in network byte order, ipv6.dns a list of 16 byte arrays
+		if family == "ipv4" {
+			servers := []uint32{}
+			for _, server := range config.DnsServers {
+				addr := netip.MustParseAddr(server).As4()
+				servers = append(servers, binary.NativeEndian.Uint32(addr[:]))
+			}
+			settings["dns"] = dbus.MakeVariant(servers)
+		} else {
+			servers := [][]byte{}
+			for _, server := range config.DnsServers {
+				addr := netip.MustParseAddr(server).As16()
+				servers = append(servers, addr[:])
+			}
+			settings["dns"] = dbus.MakeVariant(servers)
+		}
+	}
+	if len(config.DnsSearch) > 0 {
+		settings["dns-search"] = dbus.MakeVariant(config.DnsSearch)
+	}
+	if config.IgnoreAutoDns {
+		settings["ignore-auto-dns"] = dbus.MakeVariant(true)
+	}
+
+	if len(config.Routes) > 0 {
+		routeData := []map[string]dbus.Variant{}
+		for _, route := range config.Routes {
+			destination := netip.MustParsePrefix(route.Destination).Masked()
+			r := map[string]dbus.Variant{
+				"dest":   dbus.MakeVariant(destination.Addr().String()),
+				"prefix": dbus.MakeVariant(uint32(destination.Bits())),
+			}
+			if route.NextHop != "" {
+				r["next-hop"] = dbus.MakeVariant(route.NextHop)
+			}
+			if route.Metric != 0 {
+				r["metric"] = dbus.MakeVariant(route.Metric)
+			}
+			routeData = append(routeData, r)
+		}
+		settings["route-data"] = dbus.MakeVariant(routeData)
+	}
+
+	return settings
+}
+
+// ipConfigFromSettings is the inverse of ipSettings, for reporting a saved profile's NM "ipv4"/"ipv6" setting
+func ipConfigFromSettings(family string, settings map[string]dbus.Variant) *dev.WiFiIPConfig {
+	config := &dev.WiFiIPConfig{}
+
+	method, _ := settings["method"].Value().(string)
+	for m, name := range ipMethodNames {
+		if name == method {
+			config.Method = m
+		}
+	}
+	if method == "ignore" {
+		config.Method = dev.WiFiIPMethod_WIFI_IP_METHOD_DISABLED
+	}
+
+	addressData, _ := settings["address-data"].Value().([]map[string]dbus.Variant)
+	for _, address := range addressData {
+		addr, _ := address["address"].Value().(string)
+		prefix, _ := address["prefix"].Value().(uint32)
+		config.Addresses = append(config.Addresses, fmt.Sprintf("%s/%d", addr, prefix))
+	}
+	config.Gateway, _ = settings["gateway"].Value().(string)
+
+	if family == "ipv4" {
+		servers, _ := settings["dns"].Value().([]uint32)
+		for _, server := range servers {
+			var addr [4]byte
+			binary.NativeEndian.PutUint32(addr[:], server)
+			config.DnsServers = append(config.DnsServers, netip.AddrFrom4(addr).String())
+		}
+	} else {
+		servers, _ := settings["dns"].Value().([][]byte)
+		for _, server := range servers {
+			if addr, ok := netip.AddrFromSlice(server); ok {
+				config.DnsServers = append(config.DnsServers, addr.String())
+			}
+		}
+	}
+	config.DnsSearch, _ = settings["dns-search"].Value().([]string)
+	config.IgnoreAutoDns, _ = settings["ignore-auto-dns"].Value().(bool)
+
+	routeData, _ := settings["route-data"].Value().([]map[string]dbus.Variant)
+	for _, r := range routeData {
+		dest, _ := r["dest"].Value().(string)
+		prefix, _ := r["prefix"].Value().(uint32)
+		route := &dev.WiFiIPRoute{
+			Destination: fmt.Sprintf("%s/%d", dest, prefix),
+		}
+		route.NextHop, _ = r["next-hop"].Value().(string)
+		route.Metric, _ = r["metric"].Value().(uint32)
+		config.Routes = append(config.Routes, route)
+	}
+
+	return config
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NMDeviceType values we care about
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_DEVICE_TYPE_WIFI = 2
+)
+
+// NM80211Mode values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_802_11_MODE_UNKNOWN = 0
+	NM_802_11_MODE_ADHOC   = 1
+	NM_802_11_MODE_INFRA   = 2
+	NM_802_11_MODE_AP      = 3
+	NM_802_11_MODE_MESH    = 4
+)
+
+// NMActiveConnectionState values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_ACTIVE_CONNECTION_STATE_UNKNOWN      = 0
+	NM_ACTIVE_CONNECTION_STATE_ACTIVATING   = 1
+	NM_ACTIVE_CONNECTION_STATE_ACTIVATED    = 2
+	NM_ACTIVE_CONNECTION_STATE_DEACTIVATING = 3
+	NM_ACTIVE_CONNECTION_STATE_DEACTIVATED  = 4
+)
+
+var (
+	ErrNoWifiDevice = errors.New("no WiFi device found")
+	// ErrInvalidNetworkInterface is returned when an explicitly requested interface doesn't exist or isn't Wi-Fi
+	ErrInvalidNetworkInterface = errors.New("invalid network interface")
+)
+
+type wifiDevice struct {
+	path          dbus.ObjectPath
+	interfaceName string
+}
+
+func (d wifiDevice) object(conn *dbus.Conn) dbus.BusObject {
+	return conn.Object(serviceName, d.path)
+}
+
+// getAllProperties fetches every property of iface on obj in a single round trip
+func getAllProperties(ctx context.Context, obj dbus.BusObject, iface string) (map[string]dbus.Variant, error) {
+	call := obj.CallWithContext(ctx, "org.freedesktop.DBus.Properties.GetAll", 0, iface)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	props := map[string]dbus.Variant{}
+	if err := call.Store(&props); err != nil {
+		return nil, err
+	}
+
+	return props, nil
+}
+
+// findWifiDevices lists NetworkManager's Wi-Fi devices, optionally restricted to a single interface name
+func findWifiDevices(ctx context.Context, conn *dbus.Conn, networkInterfaceName string) ([]wifiDevice, error) {
+	devices, err := nmConn(conn).GetProperty("org.freedesktop.NetworkManager.AllDevices")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+
+	wifiDevices := []wifiDevice{}
+	for _, d := range devices.Value().([]dbus.ObjectPath) {
+		props, err := getAllProperties(ctx, conn.Object(serviceName, d), "org.freedesktop.NetworkManager.Device")
+		if err != nil {
+			continue // Skip on error
+		}
+
+		deviceType, _ := props["DeviceType"].Value().(uint32)
+		if deviceType != NM_DEVICE_TYPE_WIFI {
+			continue
+		}
+
+		interfaceName, _ := props["Interface"].Value().(string)
+		if networkInterfaceName != "" && interfaceName != networkInterfaceName {
+			continue
+		}
+
+		wifiDevices = append(wifiDevices, wifiDevice{
+			path:          d,
+			interfaceName: interfaceName,
+		})
+	}
+
+	return wifiDevices, nil
+}
+
+// resolveWifiDevice picks the Wi-Fi device to act on: networkInterfaceName when given, which must be a Wi-Fi
+// device NetworkManager knows about, otherwise the first Wi-Fi device
+func resolveWifiDevice(ctx context.Context, conn *dbus.Conn, networkInterfaceName string) (wifiDevice, error) {
+	devices, err := findWifiDevices(ctx, conn, networkInterfaceName)
+	if err != nil {
+		return wifiDevice{}, err
+	}
+	if len(devices) > 0 {
+		return devices[0], nil
+	}
+	if networkInterfaceName == "" {
+		return wifiDevice{}, ErrNoWifiDevice
+	}
+
+	// Tell an unknown interface apart from one that isn't Wi-Fi
+	var devicePath dbus.ObjectPath
+	call := nmConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.GetDeviceByIpIface", 0, networkInterfaceName)
+	if call.Err != nil || call.Store(&devicePath) != nil {
+		return wifiDevice{}, fmt.Errorf("%w: %q does not exist", ErrInvalidNetworkInterface, networkInterfaceName)
+	}
+
+	return wifiDevice{}, fmt.Errorf("%w: %q is not a Wi-Fi device", ErrInvalidNetworkInterface, networkInterfaceName)
+}
+
+// listConnections returns the object paths of every saved connection profile
+func listConnections(ctx context.Context, conn *dbus.Conn) ([]dbus.ObjectPath, error) {
+	call := nmSettingsConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.ListConnections", 0)
+	if call.Err != nil {
+		return nil, fmt.Errorf("failed to list connections: %v", call.Err)
+	}
+
+	connections := []dbus.ObjectPath{}
+	if err := call.Store(&connections); err != nil {
+		return nil, fmt.Errorf("failed to read connections: %v", err)
+	}
+
+	return connections, nil
+}
+
+// connectionSettings returns the (secret-less) settings of a saved connection profile
+func connectionSettings(ctx context.Context, conn *dbus.Conn, connPath dbus.ObjectPath) (map[string]map[string]dbus.Variant, error) {
+	call := conn.Object(serviceName, connPath).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.GetSettings", 0)
+	if call.Err != nil {
+		return nil, fmt.Errorf("failed to get connection settings: %v", call.Err)
+	}
+
+	settingsInfo := map[string]map[string]dbus.Variant{}
+	if err := call.Store(&settingsInfo); err != nil {
+		return nil, fmt.Errorf("failed to store connection settings: %v", err)
+	}
+
+	return settingsInfo, nil
+}
+
+// settingsSSID extracts the SSID of a Wi-Fi connection profile; ok is false for non Wi-Fi profiles
+func settingsSSID(settingsInfo map[string]map[string]dbus.Variant) (string, bool) {
+	ssidBytes, ok := settingsInfo["802-11-wireless"]["ssid"].Value().([]byte)
+	if !ok {
+		return "", false
+	}
+
+	return string(ssidBytes), true
+}
+
+// secondsSinceBoot returns CLOCK_BOOTTIME in whole seconds, which NetworkManager uses for timestamps like LastSeen.
+// /proc/uptime includes time spent suspended, so it's on the same clock.
+func secondsSinceBoot() (int64, error) {
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(uptime))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime contents: %q", uptime)
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(seconds), nil
+}
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// maxOperations is how many operation records are kept; the oldest finished ones are dropped first
+const maxOperations = 100
+
+var (
+	ErrOperationExists   = errors.New("operation ID already in use")
+	ErrOperationNotFound = errors.New("operation not found")
+)
+
+// ProgressFunc is told about each step an operation moves on to; a nil ProgressFunc ignores them
+type ProgressFunc func(step dev.WiFiOperationStep)
+
+func (p ProgressFunc) report(step dev.WiFiOperationStep) {
+	if p != nil {
+		p(step)
+	}
+}
+
+// Operations keeps a record of disruptive requests, their progress and how they ended, so a client that lost its
+// connection (e.g. because Connect moved the device off the hotspot it was talking over) can look up the outcome
+// later
+type Operations struct {
+	mu         sync.Mutex
+	operations map[string]*dev.WiFiOperation
+	// changed is closed (and replaced) whenever the operation with that ID changes, waking up watchers
+	changed map[string]chan struct{}
+	order   []string // IDs, oldest first
+}
+
+func NewOperations() *Operations {
+	return &Operations{
+		operations: map[string]*dev.WiFiOperation{},
+		changed:    map[string]chan struct{}{},
+	}
+}
+
+// Start records a running operation for procedure and returns its ID, which is id unless that's empty
+func (o *Operations) Start(id string, procedure string) (string, error) {
+	if id == "" {
+		id = newOperationID()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, exists := o.operations[id]; exists {
+		return "", fmt.Errorf("%w: %q", ErrOperationExists, id)
+	}
+
+	now := timestamppb.Now()
+	o.operations[id] = &dev.WiFiOperation{
+		Id:        id,
+		Procedure: procedure,
+		State:     dev.WiFiOperationState_WIFI_OPERATION_STATE_RUNNING,
+		StartedAt: now,
+		Step:      dev.WiFiOperationStep_WIFI_OPERATION_STEP_PREPARING,
+		UpdatedAt: now,
+	}
+	o.changed[id] = make(chan struct{})
+	o.order = append(o.order, id)
+	o.prune()
+
+	return id, nil
+}
+
+// Progress returns a ProgressFunc recording the steps of operation id
+func (o *Operations) Progress(id string) ProgressFunc {
+	return func(step dev.WiFiOperationStep) {
+		o.update(id, func(operation *dev.WiFiOperation) {
+			// Steps reported after Finish (e.g. by a goroutine still winding down) would hide the outcome
+			if operation.State == dev.WiFiOperationState_WIFI_OPERATION_STATE_RUNNING {
+				operation.Step = step
+			}
+		})
+	}
+}
+
+// SetDisconnectResult records what a successful Disconnect operation did
+func (o *Operations) SetDisconnectResult(id string, response *dev.WiFiDisconnectResponse) {
+	o.update(id, func(operation *dev.WiFiOperation) {
+		operation.DisconnectResult = response
+	})
+}
+
+// Finish records the outcome of operation id; err is what the operation returned
+func (o *Operations) Finish(id string, err error) {
+	o.update(id, func(operation *dev.WiFiOperation) {
+		operation.FinishedAt = timestamppb.Now()
+		if err == nil {
+			operation.State = dev.WiFiOperationState_WIFI_OPERATION_STATE_SUCCEEDED
+			operation.Step = dev.WiFiOperationStep_WIFI_OPERATION_STEP_DONE
+			return
+		}
+
+		operation.State = dev.WiFiOperationState_WIFI_OPERATION_STATE_FAILED
+		operation.Step = dev.WiFiOperationStep_WIFI_OPERATION_STEP_FAILED
+		var rollbackErr *RollbackError
+		if errors.As(err, &rollbackErr) {
+			operation.State = dev.WiFiOperationState_WIFI_OPERATION_STATE_ROLLED_BACK
+		}
+		operation.Error = err.Error()
+		operation.ConnectFailure = connectFailureFromError(err)
+	})
+}
+
+// Get returns a copy of operation id
+func (o *Operations) Get(id string) (*dev.WiFiOperation, error) {
+	operation, _, err := o.get(id)
+	return operation, err
+}
+
+// Watch sends a copy of operation id right away, and again whenever it changes, until it has finished or ctx is
+// done
+func (o *Operations) Watch(ctx context.Context, id string, send func(*dev.WiFiOperation) error) error {
+	for {
+		operation, changed, err := o.get(id)
+		if err != nil {
+			return err
+		}
+		if err := send(operation); err != nil {
+			return err
+		}
+		if operation.State != dev.WiFiOperationState_WIFI_OPERATION_STATE_RUNNING {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// get returns a copy of operation id, and the channel that's closed on its next change
+func (o *Operations) get(id string) (*dev.WiFiOperation, <-chan struct{}, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	operation, ok := o.operations[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrOperationNotFound, id)
+	}
+
+	return proto.Clone(operation).(*dev.WiFiOperation), o.changed[id], nil
+}
+
+// update applies change to operation id and wakes up its watchers
+func (o *Operations) update(id string, change func(operation *dev.WiFiOperation)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	operation, ok := o.operations[id]
+	if !ok {
+		return
+	}
+
+	change(operation)
+	operation.UpdatedAt = timestamppb.Now()
+
+	close(o.changed[id])
+	o.changed[id] = make(chan struct{})
+}
+
+// prune drops the oldest finished operations beyond maxOperations; running ones are always kept
+func (o *Operations) prune() {
+	excess := len(o.order) - maxOperations
+	if excess <= 0 {
+		return
+	}
+
+	kept := o.order[:0]
+	for _, id := range o.order {
+		if excess > 0 && o.operations[id].State != dev.WiFiOperationState_WIFI_OPERATION_STATE_RUNNING {
+			delete(o.operations, id)
+			delete(o.changed, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	o.order = kept
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// managedProfileUserDataKey marks the profiles iotnetlab created, in the profile's "user" setting (user.data)
+const managedProfileUserDataKey = "com.uinta-labs.iotnetlab.managed"
+
+// profileSectionsOwned are replaced wholesale when updating an existing profile; anything else the profile has
+// (metered, proxy, ...) is kept
+var profileSectionsOwned = []string{"802-11-wireless", "802-11-wireless-security", "802-1x", "ipv4", "ipv6"}
+
+// profileToReuse picks which of the saved profiles for ssid a new connection updates: the one iotnetlab owns with
+// the highest priority, or else one left behind by older iotnetlab versions (named after the SSID and unmarked).
+// Profiles someone else made are left alone, so nil means a new profile has to be added.
+func profileToReuse(profiles []savedProfile, ssid string) *savedProfile {
+	var reuse *savedProfile
+	for _, isCandidate := range []func(savedProfile) bool{
+		func(p savedProfile) bool { return p.managed },
+		func(p savedProfile) bool { return isLegacyManagedProfile(p, ssid) },
+	} {
+		for i := range profiles {
+			if isCandidate(profiles[i]) && (reuse == nil || profiles[i].priority > reuse.priority) {
+				reuse = &profiles[i]
+			}
+		}
+		if reuse != nil {
+			break
+		}
+	}
+
+	return reuse
+}
+
+// upsertWifiProfile stores connection as the profile for ssid and returns its path, updating the profile
+// profileToReuse picks from the saved profiles for ssid in place or adding a new one. Remaining iotnetlab profiles
+// for ssid are deleted, so stale passwords don't compete during autoconnect.
+func upsertWifiProfile(ctx context.Context, conn *dbus.Conn, ssid string, profiles []savedProfile, connection map[string]map[string]dbus.Variant) (dbus.ObjectPath, error) {
+	reuse := profileToReuse(profiles, ssid)
+
+	var connPath dbus.ObjectPath
+	if reuse == nil {
+		markManaged(connection)
+		call := nmSettingsConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.AddConnection", 0, connection)
+		if call.Err != nil {
+			return "", fmt.Errorf("failed to add connection: %v", call.Err)
+		}
+
+		if err := call.Store(&connPath); err != nil {
+			return "", fmt.Errorf("failed to store new connection path: %v", err)
+		}
+	} else {
+		log.Printf("Updating existing connection profile %q (%s)", reuse.id, reuse.path)
+		if err := updateWifiProfile(ctx, conn, reuse.path, connection); err != nil {
+			return "", err
+		}
+		connPath = reuse.path
+	}
+
+	if err := deleteDuplicateProfiles(ctx, conn, ssid, profiles, connPath); err != nil {
+		return "", err
+	}
+
+	return connPath, nil
+}
+
+// markManaged tags connection as created by iotnetlab. user.data is shared with whoever else keeps data in the
+// profile, so the tag is added to what's there.
+func markManaged(connection map[string]map[string]dbus.Variant) {
+	data := map[string]string{}
+	if existing, ok := connection["user"]["data"].Value().(map[string]string); ok {
+		for key, value := range existing {
+			data[key] = value
+		}
+	}
+	data[managedProfileUserDataKey] = "true"
+
+	if connection["user"] == nil {
+		connection["user"] = map[string]dbus.Variant{}
+	}
+	connection["user"]["data"] = dbus.MakeVariant(data)
+}
+
+// deleteDuplicateProfiles deletes the iotnetlab profiles for ssid among profiles, except keep
+func deleteDuplicateProfiles(ctx context.Context, conn *dbus.Conn, ssid string, profiles []savedProfile, keep dbus.ObjectPath) error {
+	for _, p := range profiles {
+		if p.path == keep || !(p.managed || isLegacyManagedProfile(p, ssid)) {
+			continue
+		}
+		log.Printf("Deleting duplicate connection profile %q (%s)", p.id, p.path)
+		if err := deleteConnection(ctx, conn, p.path, p.uuid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addAndActivateUnsaved adds connection as an in-memory profile (persist "memory" or "volatile") and activates it
+// on devicePath in one go, returning the profile and active connection paths
+func addAndActivateUnsaved(ctx context.Context, conn *dbus.Conn, connection map[string]map[string]dbus.Variant, devicePath dbus.ObjectPath, persist string) (dbus.ObjectPath, dbus.ObjectPath, error) {
+	markManaged(connection)
+
+	options := map[string]dbus.Variant{
+		"persist": dbus.MakeVariant(persist),
+	}
+	call := nmConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.AddAndActivateConnection2", 0, connection, devicePath, dbus.ObjectPath("/"), options)
+	if call.Err != nil {
+		return "", "", fmt.Errorf("failed to add and activate connection: %v", call.Err)
+	}
+
+	var connPath, activeConnPath dbus.ObjectPath
+	var result map[string]dbus.Variant
+	if err := call.Store(&connPath, &activeConnPath, &result); err != nil {
+		return "", "", fmt.Errorf("failed to store new connection paths: %v", err)
+	}
+
+	return connPath, activeConnPath, nil
+}
+
+// saveProfile writes an in-memory profile to disk, and replaces the other iotnetlab profiles for ssid with it
+func saveProfile(ctx context.Context, conn *dbus.Conn, ssid string, connPath dbus.ObjectPath) error {
+	if err := conn.Object(serviceName, connPath).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.Save", 0).Err; err != nil {
+		return fmt.Errorf("failed to save connection: %v", err)
+	}
+
+	savedProfiles, err := savedWifiProfiles(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return deleteDuplicateProfiles(ctx, conn, ssid, savedProfiles[ssid], connPath)
+}
+
+// isLegacyManagedProfile matches profiles created before iotnetlab marked its profiles: those are named after the SSID
+func isLegacyManagedProfile(p savedProfile, ssid string) bool {
+	return !p.managed && p.id == ssid
+}
+
+// updateWifiProfile overlays connection onto the profile at connPath and saves it with Connection.Update
+func updateWifiProfile(ctx context.Context, conn *dbus.Conn, connPath dbus.ObjectPath, connection map[string]map[string]dbus.Variant) error {
+	existing, err := connectionSettings(ctx, conn, connPath)
+	if err != nil {
+		return err
+	}
+
+	for _, section := range profileSectionsOwned {
+		delete(existing, section)
+	}
+	// A profile left bound to another interface would fail to activate on the one we're connecting on
+	if _, ok := connection["connection"]["interface-name"]; !ok {
+		delete(existing["connection"], "interface-name")
+	}
+	for section, values := range connection {
+		if existing[section] == nil {
+			existing[section] = map[string]dbus.Variant{}
+		}
+		for key, value := range values {
+			existing[section][key] = value
+		}
+	}
+	markManaged(existing)
+
+	if err := conn.Object(serviceName, connPath).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.Update", 0, existing).Err; err != nil {
+		return fmt.Errorf("failed to update connection: %v", err)
+	}
+
+	return nil
+}
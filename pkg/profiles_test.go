@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestMarkManaged(t *testing.T) {
+	tests := []struct {
+		name string
+		user map[string]dbus.Variant
+		want map[string]string
+	}{
+		{
+			name: "no user setting",
+			want: map[string]string{managedProfileUserDataKey: "true"},
+		},
+		{
+			name: "user setting without data",
+			user: map[string]dbus.Variant{},
+			want: map[string]string{managedProfileUserDataKey: "true"},
+		},
+		{
+			name: "keeps other keys",
+			user: map[string]dbus.Variant{
+				"data": dbus.MakeVariant(map[string]string{"org.example.site": "plant-3"}),
+			},
+			want: map[string]string{"org.example.site": "plant-3", managedProfileUserDataKey: "true"},
+		},
+		{
+			name: "already managed",
+			user: map[string]dbus.Variant{
+				"data": dbus.MakeVariant(map[string]string{managedProfileUserDataKey: "true"}),
+			},
+			want: map[string]string{managedProfileUserDataKey: "true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connection := map[string]map[string]dbus.Variant{
+				"connection": {"id": dbus.MakeVariant("office")},
+			}
+			if tt.user != nil {
+				connection["user"] = tt.user
+			}
+
+			markManaged(connection)
+
+			got, _ := connection["user"]["data"].Value().(map[string]string)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("user.data = %v, want %v", got, tt.want)
+			}
+			if profile := parseSavedProfile("/", connection); !profile.managed {
+				t.Errorf("profile isn't recognized as managed")
+			}
+		})
+	}
+}
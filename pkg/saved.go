@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"context"
+	"log"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// savedProfile is the subset of a saved Wi-Fi client profile's settings we work with
+type savedProfile struct {
+	path          dbus.ObjectPath
+	id            string
+	uuid          string
+	autoconnect   bool
+	priority      int32
+	interfaceName string
+	// managed is true for profiles iotnetlab created
+	managed bool
+}
+
+// savedWifiProfiles indexes NetworkManager's saved Wi-Fi client profiles by SSID. Hotspot (AP mode) profiles are
+// left out, since they aren't networks the device can join.
+func savedWifiProfiles(ctx context.Context, conn *dbus.Conn) (map[string][]savedProfile, error) {
+	connections, err := listConnections(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string][]savedProfile{}
+	for _, c := range connections {
+		settingsInfo, err := connectionSettings(ctx, conn, c)
+		if err != nil {
+			log.Printf("Failed to read connection %s: %v", c, err)
+			continue
+		}
+
+		ssid, ok := clientProfileSSID(settingsInfo)
+		if !ok {
+			continue
+		}
+
+		profile := parseSavedProfile(c, settingsInfo)
+		profiles[ssid] = append(profiles[ssid], profile)
+	}
+
+	return profiles, nil
+}
+
+// clientProfileSSID returns the SSID of a Wi-Fi client profile; ok is false for other profiles, including hotspots
+func clientProfileSSID(settingsInfo map[string]map[string]dbus.Variant) (string, bool) {
+	ssid, ok := settingsSSID(settingsInfo)
+	if !ok {
+		return "", false
+	}
+	if mode, _ := settingsInfo["802-11-wireless"]["mode"].Value().(string); mode == "ap" {
+		return "", false
+	}
+
+	return ssid, true
+}
+
+func parseSavedProfile(connPath dbus.ObjectPath, settingsInfo map[string]map[string]dbus.Variant) savedProfile {
+	profile := savedProfile{
+		path: connPath,
+		// NM leaves out properties that are at their default, and autoconnect defaults to true
+		autoconnect: true,
+	}
+	profile.id, _ = settingsInfo["connection"]["id"].Value().(string)
+	profile.uuid, _ = settingsInfo["connection"]["uuid"].Value().(string)
+	profile.interfaceName, _ = settingsInfo["connection"]["interface-name"].Value().(string)
+	if autoconnect, ok := settingsInfo["connection"]["autoconnect"].Value().(bool); ok {
+		profile.autoconnect = autoconnect
+	}
+	profile.priority, _ = settingsInfo["connection"]["autoconnect-priority"].Value().(int32)
+	userData, _ := settingsInfo["user"]["data"].Value().(map[string]string)
+	profile.managed = userData[managedProfileUserDataKey] == "true"
+
+	return profile
+}
+
+// bestSavedProfile picks the profile NetworkManager would prefer for networkInterfaceName: the highest priority
+// one that isn't bound to a different interface
+func bestSavedProfile(profiles []savedProfile, networkInterfaceName string) (savedProfile, bool) {
+	var best savedProfile
+	found := false
+	for _, profile := range profiles {
+		if profile.interfaceName != "" && profile.interfaceName != networkInterfaceName {
+			continue
+		}
+		if !found || profile.priority > best.priority {
+			best = profile
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func annotateAccessPoint(accessPoint *dev.WiFiAccessPoint, isConnected bool, profiles []savedProfile, networkInterfaceName string) {
+	accessPoint.IsConnected = isConnected
+
+	profile, ok := bestSavedProfile(profiles, networkInterfaceName)
+	if !ok {
+		return
+	}
+
+	accessPoint.IsSaved = true
+	accessPoint.Autoconnect = profile.autoconnect
+	accessPoint.Priority = profile.priority
+	accessPoint.SavedConnectionUuid = profile.uuid
+}
@@ -0,0 +1,426 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+var (
+	ErrSavedNetworkNotFound      = errors.New("saved network not found")
+	ErrInvalidSavedNetworkUpdate = errors.New("invalid saved network update")
+)
+
+var keyManagementNames = map[string]dev.WiFiKeyManagement{
+	"none":                dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP,
+	"owe":                 dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE,
+	"wpa-psk":             dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK,
+	"sae":                 dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE,
+	"wpa-eap":             dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP,
+	"wpa-eap-suite-b-192": dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192,
+}
+
+var keyManagementSecurityTypes = map[dev.WiFiKeyManagement]dev.WiFiSecurityType{
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OPEN:                dev.WiFiSecurityType_WIFI_SECURITY_OPEN,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE:                 dev.WiFiSecurityType_WIFI_SECURITY_OWE,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:                 dev.WiFiSecurityType_WIFI_SECURITY_WEP,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK:             dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE:                 dev.WiFiSecurityType_WIFI_SECURITY_WPA3_PSK,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP:             dev.WiFiSecurityType_WIFI_SECURITY_WPA2_EAP,
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192: dev.WiFiSecurityType_WIFI_SECURITY_WPA3_EAP_192,
+}
+
+// ListSavedNetworks lists the saved Wi-Fi client profiles, highest priority (then most recently used) first. store
+// is the secret agent's, if there is one, which agent-owned secrets are looked up in.
+func ListSavedNetworks(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiListSavedNetworksRequest) (*dev.WiFiListSavedNetworksResponse, error) {
+	networks, err := savedNetworks(ctx, conn, store, request.NetworkInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dev.WiFiListSavedNetworksResponse{
+		Networks: networks,
+	}, nil
+}
+
+// GetSavedNetwork returns a single saved profile including its EAP and IP configuration, without secrets
+func GetSavedNetwork(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiGetSavedNetworkRequest) (*dev.WiFiGetSavedNetworkResponse, error) {
+	connPath, settingsInfo, err := savedNetworkByUUID(ctx, conn, request.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	activeConnections, err := activeConnectionProfiles(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dev.WiFiGetSavedNetworkResponse{
+		Network: savedNetwork(store, connPath, settingsInfo, activeConnections[connPath], true),
+	}, nil
+}
+
+// UpdateSavedNetwork changes the fields set in request on a saved profile. A new password goes to store when there
+// is one.
+func UpdateSavedNetwork(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiUpdateSavedNetworkRequest) (*dev.WiFiUpdateSavedNetworkResponse, error) {
+	if err := ValidateIPConfig("ipv4", request.Ipv4); err != nil {
+		return nil, err
+	}
+	if err := ValidateIPConfig("ipv6", request.Ipv6); err != nil {
+		return nil, err
+	}
+
+	connPath, settingsInfo, err := savedNetworkByUUID(ctx, conn, request.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Autoconnect != nil {
+		settingsInfo["connection"]["autoconnect"] = dbus.MakeVariant(*request.Autoconnect)
+	}
+	if request.Priority != nil {
+		settingsInfo["connection"]["autoconnect-priority"] = dbus.MakeVariant(*request.Priority)
+	}
+	if request.NetworkInterface != nil {
+		if *request.NetworkInterface == "" {
+			delete(settingsInfo["connection"], "interface-name")
+		} else {
+			device, err := resolveWifiDevice(ctx, conn, *request.NetworkInterface)
+			if err != nil {
+				return nil, err
+			}
+			settingsInfo["connection"]["interface-name"] = dbus.MakeVariant(device.interfaceName)
+		}
+	}
+	if request.Hidden != nil {
+		settingsInfo["802-11-wireless"]["hidden"] = dbus.MakeVariant(*request.Hidden)
+	}
+	if request.Ipv4 != nil {
+		settingsInfo["ipv4"] = ipSettings("ipv4", request.Ipv4)
+	}
+	if request.Ipv6 != nil {
+		settingsInfo["ipv6"] = ipSettings("ipv6", request.Ipv6)
+	}
+	if request.Password != nil {
+		if err := setProfilePassword(settingsInfo, *request.Password); err != nil {
+			return nil, err
+		}
+		if err := storeAgentSecrets(store, request.Uuid, takeAgentSecrets(store, settingsInfo)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Object(serviceName, connPath).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.Update", 0, settingsInfo).Err; err != nil {
+		return nil, fmt.Errorf("failed to update connection: %v", err)
+	}
+
+	network, err := GetSavedNetwork(ctx, conn, store, &dev.WiFiGetSavedNetworkRequest{Uuid: request.Uuid})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dev.WiFiUpdateSavedNetworkResponse{
+		Network: network.Network,
+	}, nil
+}
+
+// ForgetNetwork deletes a saved profile by UUID, or every profile for an SSID
+func ForgetNetwork(ctx context.Context, conn *dbus.Conn, request *dev.WiFiForgetNetworkRequest) (*dev.WiFiForgetNetworkResponse, error) {
+	if (request.Uuid == "") == (request.SSID == "") {
+		return nil, fmt.Errorf("%w: exactly one of uuid and SSID is required", ErrInvalidSavedNetworkUpdate)
+	}
+
+	var profiles []savedProfile
+	if request.Uuid != "" {
+		connPath, settingsInfo, err := savedNetworkByUUID(ctx, conn, request.Uuid)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, parseSavedProfile(connPath, settingsInfo))
+	} else {
+		savedProfiles, err := savedWifiProfiles(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		profiles = savedProfiles[request.SSID]
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("%w: no profile for %q", ErrSavedNetworkNotFound, request.SSID)
+		}
+	}
+
+	for _, profile := range profiles {
+		if err := deleteConnection(ctx, conn, profile.path, profile.uuid); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dev.WiFiForgetNetworkResponse{
+		ForgottenProfiles: int32(len(profiles)),
+	}, nil
+}
+
+// ReorderNetworks gives the listed profiles descending autoconnect priorities in the order given, and every other
+// saved profile priority 0
+func ReorderNetworks(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiReorderNetworksRequest) (*dev.WiFiReorderNetworksResponse, error) {
+	priorities := map[string]int32{}
+	for i, uuid := range request.Uuids {
+		if _, duplicate := priorities[uuid]; duplicate {
+			return nil, fmt.Errorf("%w: %s is listed more than once", ErrInvalidSavedNetworkUpdate, uuid)
+		}
+		priorities[uuid] = int32(len(request.Uuids) - i)
+	}
+
+	profiles, err := savedWifiProfiles(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, ssidProfiles := range profiles {
+		for _, profile := range ssidProfiles {
+			known[profile.uuid] = true
+		}
+	}
+	for uuid := range priorities {
+		if !known[uuid] {
+			return nil, fmt.Errorf("%w: %s", ErrSavedNetworkNotFound, uuid)
+		}
+	}
+
+	for _, ssidProfiles := range profiles {
+		for _, profile := range ssidProfiles {
+			priority := priorities[profile.uuid]
+			if profile.priority == priority {
+				continue
+			}
+
+			settingsInfo, err := connectionSettings(ctx, conn, profile.path)
+			if err != nil {
+				return nil, err
+			}
+			settingsInfo["connection"]["autoconnect-priority"] = dbus.MakeVariant(priority)
+			if err := conn.Object(serviceName, profile.path).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.Connection.Update", 0, settingsInfo).Err; err != nil {
+				return nil, fmt.Errorf("failed to update connection: %v", err)
+			}
+		}
+	}
+
+	networks, err := savedNetworks(ctx, conn, store, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &dev.WiFiReorderNetworksResponse{
+		Networks: networks,
+	}, nil
+}
+
+func savedNetworks(ctx context.Context, conn *dbus.Conn, store *SecretStore, networkInterfaceName string) ([]*dev.WiFiSavedNetwork, error) {
+	connections, err := listConnections(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	activeConnections, err := activeConnectionProfiles(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	networks := []*dev.WiFiSavedNetwork{}
+	for _, c := range connections {
+		settingsInfo, err := connectionSettings(ctx, conn, c)
+		if err != nil {
+			log.Printf("Failed to read connection %s: %v", c, err)
+			continue
+		}
+		if _, ok := clientProfileSSID(settingsInfo); !ok {
+			continue
+		}
+		if !profileMatchesInterface(settingsInfo, networkInterfaceName) {
+			continue
+		}
+
+		networks = append(networks, savedNetwork(store, c, settingsInfo, activeConnections[c], false))
+	}
+
+	sort.SliceStable(networks, func(i, j int) bool {
+		if networks[i].Priority != networks[j].Priority {
+			return networks[i].Priority > networks[j].Priority
+		}
+		return networks[i].LastConnected.AsTime().After(networks[j].LastConnected.AsTime())
+	})
+
+	return networks, nil
+}
+
+// savedNetworkByUUID finds a Wi-Fi client profile and returns its path and settings
+func savedNetworkByUUID(ctx context.Context, conn *dbus.Conn, uuid string) (dbus.ObjectPath, map[string]map[string]dbus.Variant, error) {
+	var connPath dbus.ObjectPath
+	call := nmSettingsConn(conn).CallWithContext(ctx, "org.freedesktop.NetworkManager.Settings.GetConnectionByUuid", 0, uuid)
+	if call.Err != nil || call.Store(&connPath) != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrSavedNetworkNotFound, uuid)
+	}
+
+	settingsInfo, err := connectionSettings(ctx, conn, connPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := clientProfileSSID(settingsInfo); !ok {
+		return "", nil, fmt.Errorf("%w: %s is not a Wi-Fi network", ErrSavedNetworkNotFound, uuid)
+	}
+
+	return connPath, settingsInfo, nil
+}
+
+// activeConnectionProfiles returns the profiles that are currently active
+func activeConnectionProfiles(conn *dbus.Conn) (map[dbus.ObjectPath]bool, error) {
+	activeConnections, err := nmConn(conn).GetProperty("org.freedesktop.NetworkManager.ActiveConnections")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active connections: %v", err)
+	}
+
+	profiles := map[dbus.ObjectPath]bool{}
+	for _, activeConnPath := range activeConnections.Value().([]dbus.ObjectPath) {
+		connProp, err := conn.Object(serviceName, activeConnPath).GetProperty("org.freedesktop.NetworkManager.Connection.Active.Connection")
+		if err != nil {
+			continue
+		}
+		if connPath, ok := connProp.Value().(dbus.ObjectPath); ok {
+			profiles[connPath] = true
+		}
+	}
+
+	return profiles, nil
+}
+
+// savedNetwork describes the profile at connPath. detailed adds the EAP and IP configuration.
+func savedNetwork(store *SecretStore, connPath dbus.ObjectPath, settingsInfo map[string]map[string]dbus.Variant, isConnected bool, detailed bool) *dev.WiFiSavedNetwork {
+	ssid, _ := settingsSSID(settingsInfo)
+	profile := parseSavedProfile(connPath, settingsInfo)
+	keyManagement := profileKeyManagement(settingsInfo)
+
+	network := &dev.WiFiSavedNetwork{
+		Uuid:             profile.uuid,
+		Id:               profile.id,
+		SSID:             ssid,
+		SecurityType:     keyManagementSecurityTypes[keyManagement],
+		KeyManagement:    keyManagement,
+		Autoconnect:      profile.autoconnect,
+		Priority:         profile.priority,
+		NetworkInterface: profile.interfaceName,
+		Managed:          profile.managed,
+		IsConnected:      isConnected,
+		HasSecret:        profileHasSecret(store, profile.uuid, settingsInfo, keyManagement),
+	}
+	network.Hidden, _ = settingsInfo["802-11-wireless"]["hidden"].Value().(bool)
+	if timestamp, _ := settingsInfo["connection"]["timestamp"].Value().(uint64); timestamp > 0 {
+		network.LastConnected = timestamppb.New(time.Unix(int64(timestamp), 0))
+	}
+
+	if detailed {
+		network.EapConfig = profileEAPConfig(settingsInfo["802-1x"])
+		network.Ipv4 = ipConfigFromSettings("ipv4", settingsInfo["ipv4"])
+		network.Ipv6 = ipConfigFromSettings("ipv6", settingsInfo["ipv6"])
+	}
+
+	return network
+}
+
+func profileKeyManagement(settingsInfo map[string]map[string]dbus.Variant) dev.WiFiKeyManagement {
+	keyMgmt, ok := settingsInfo["802-11-wireless-security"]["key-mgmt"].Value().(string)
+	if !ok {
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OPEN
+	}
+
+	return keyManagementNames[keyMgmt]
+}
+
+// profileHasSecret tells from the secret's flags whether one is stored for the profile, without fetching it: NM
+// keeps system-owned secrets itself, agent-owned ones are in store, and unsaved ones aren't kept at all
+func profileHasSecret(store *SecretStore, uuid string, settingsInfo map[string]map[string]dbus.Variant, keyManagement dev.WiFiKeyManagement) bool {
+	settingName, secretKey := "802-11-wireless-security", "psk"
+	switch keyManagement {
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OPEN, dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE:
+		return false
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:
+		secretKey = "wep-key0"
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP, dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192:
+		settingName, secretKey = "802-1x", "password"
+	}
+
+	flags, _ := settingsInfo[settingName][agentOwnedSecrets[settingName][secretKey]].Value().(uint32)
+	switch {
+	case flags&(NM_SETTING_SECRET_FLAG_NOT_SAVED|NM_SETTING_SECRET_FLAG_NOT_REQUIRED) != 0:
+		return false
+	case flags&NM_SETTING_SECRET_FLAG_AGENT_OWNED != 0:
+		return store != nil && store.Get(uuid, settingName)[secretKey] != ""
+	}
+
+	return true
+}
+
+// setProfilePassword puts password wherever the profile's key management keeps it
+func setProfilePassword(settingsInfo map[string]map[string]dbus.Variant, password string) error {
+	keyManagement := profileKeyManagement(settingsInfo)
+	var v violations
+	validatePassword(&v, "password", keyManagement, password)
+	if err := v.err(ErrInvalidSavedNetworkUpdate); err != nil {
+		return err
+	}
+
+	switch keyManagement {
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK, dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE:
+		settingsInfo["802-11-wireless-security"]["psk"] = dbus.MakeVariant(password)
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:
+		settingsInfo["802-11-wireless-security"]["wep-key0"] = dbus.MakeVariant(password)
+		settingsInfo["802-11-wireless-security"]["wep-key-type"] = dbus.MakeVariant(wepKeyType(password))
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP:
+		if settingsInfo["802-1x"] == nil {
+			return fmt.Errorf("%w: profile has no 802-1x settings", ErrInvalidSavedNetworkUpdate)
+		}
+		settingsInfo["802-1x"]["password"] = dbus.MakeVariant(password)
+	default:
+		return fmt.Errorf("%w: a %s network has no password", ErrInvalidSavedNetworkUpdate, keyManagement)
+	}
+
+	return nil
+}
+
+// profileEAPConfig reports the non-secret parts of an NM "802-1x" setting; nil if there is none
+func profileEAPConfig(settings map[string]dbus.Variant) *dev.WiFiEAPConfig {
+	if settings == nil {
+		return nil
+	}
+
+	config := &dev.WiFiEAPConfig{}
+	if methods, _ := settings["eap"].Value().([]string); len(methods) > 0 {
+		for method, name := range eapMethodNames {
+			if name == methods[0] {
+				config.Method = method
+			}
+		}
+	}
+	config.Identity, _ = settings["identity"].Value().(string)
+	config.AnonymousIdentity, _ = settings["anonymous-identity"].Value().(string)
+	if phase2Auth, ok := settings["phase2-auth"].Value().(string); ok {
+		for auth, name := range eapPhase2AuthNames[config.Method] {
+			if name == strings.ToLower(phase2Auth) && auth != dev.WiFiEAPPhase2Auth_WIFI_EAP_PHASE2_AUTH_DEFAULT {
+				config.Phase2Auth = auth
+			}
+		}
+	}
+	config.DomainSuffixMatch, _ = settings["domain-suffix-match"].Value().(string)
+	config.AltsubjectMatches, _ = settings["altsubject-matches"].Value().([]string)
+	config.UseSystemCaCerts, _ = settings["system-ca-certs"].Value().(bool)
+
+	return config
+}
@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+const (
+	// scanCacheExpiry is how long an access point that stopped showing up in station mode scans is kept around
+	scanCacheExpiry = 2 * time.Minute
+	// scanCacheScanTimeout bounds each background scan
+	scanCacheScanTimeout = 15 * time.Second
+	// hotspotDownTimeout bounds how long we wait for the radio to leave AP mode during a hotspot cycle
+	hotspotDownTimeout = 5 * time.Second
+)
+
+type cachedAccessPoint struct {
+	accessPoint *dev.WiFiAccessPoint
+	seenAt      time.Time
+}
+
+// ScanCache keeps the most recent scan results of each radio around, so there's still a network list to offer once
+// a radio has switched to AP mode for a hotspot and can no longer scan. Radios in station mode are always scanned.
+type ScanCache struct {
+	conn *dbus.Conn
+
+	mu           sync.RWMutex
+	accessPoints map[string]map[string]cachedAccessPoint // keyed by interface, then BSSID
+}
+
+func NewScanCache(conn *dbus.Conn) *ScanCache {
+	return &ScanCache{
+		conn:         conn,
+		accessPoints: map[string]map[string]cachedAccessPoint{},
+	}
+}
+
+// Run scans on the radios in station mode every interval, until ctx is done
+func (c *ScanCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(ctx, ""); err != nil {
+				log.Printf("Background scan failed: %v", err)
+			}
+		}
+	}
+}
+
+// Refresh scans on the matching radios that are in station mode now and stores the results. Call it right before
+// starting a hotspot to have an up-to-date snapshot while the radio is busy.
+func (c *ScanCache) Refresh(ctx context.Context, networkInterfaceName string) error {
+	stationDevices, _, err := devicesByMode(ctx, c.conn, networkInterfaceName)
+	if err != nil {
+		return err
+	}
+	if len(stationDevices) == 0 {
+		return nil
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, scanCacheScanTimeout)
+	defer cancel()
+
+	c.store(scanDevices(scanCtx, c.conn, stationDevices))
+	return nil
+}
+
+// Scan scans on the radios matching networkInterfaceName. Those serving a hotspot contribute their cached results
+// instead, or with cycleHotspot, briefly take the hotspot down to scan and bring it back up again.
+func (c *ScanCache) Scan(ctx context.Context, networkInterfaceName string, cycleHotspot bool) (*dev.WiFiScanResult, error) {
+	stationDevices, apDevices, err := devicesByMode(ctx, c.conn, networkInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(stationDevices) == 0 && len(apDevices) == 0 {
+		return nil, ErrNoWifiDevice
+	}
+
+	if cycleHotspot && len(apDevices) > 0 {
+		deviceScans, err := c.cycleHotspotAndScan(ctx, stationDevices, apDevices)
+		if err != nil {
+			return nil, err
+		}
+		c.store(deviceScans)
+		return mergeDeviceScans(deviceScans), nil
+	}
+
+	deviceScans := scanDevices(ctx, c.conn, stationDevices)
+	c.store(deviceScans)
+	for _, d := range apDevices {
+		deviceScans = append(deviceScans, c.cachedScan(d.interfaceName))
+	}
+
+	return mergeDeviceScans(deviceScans), nil
+}
+
+// Cached returns the cached access points of networkInterfaceName (every radio when empty), with age_seconds
+// telling how long ago each was last seen
+func (c *ScanCache) Cached(networkInterfaceName string) *dev.WiFiScanResult {
+	c.mu.RLock()
+	interfaceNames := make([]string, 0, len(c.accessPoints))
+	for interfaceName := range c.accessPoints {
+		if networkInterfaceName == "" || interfaceName == networkInterfaceName {
+			interfaceNames = append(interfaceNames, interfaceName)
+		}
+	}
+	c.mu.RUnlock()
+	sort.Strings(interfaceNames)
+
+	deviceScans := make([]deviceScan, 0, len(interfaceNames))
+	for _, interfaceName := range interfaceNames {
+		deviceScans = append(deviceScans, c.cachedScan(interfaceName))
+	}
+
+	scanResult := mergeDeviceScans(deviceScans)
+	scanResult.Stale = true
+	scanResult.FromCache = true
+	return scanResult
+}
+
+// cachedScan returns the cached access points of a single radio as if it had just scanned
+func (c *ScanCache) cachedScan(interfaceName string) deviceScan {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	deviceScan := deviceScan{
+		interfaceName: interfaceName,
+		accessPoints:  make([]*dev.WiFiAccessPoint, 0, len(c.accessPoints[interfaceName])),
+		fromCache:     true,
+	}
+	for _, cached := range c.accessPoints[interfaceName] {
+		accessPoint := proto.Clone(cached.accessPoint).(*dev.WiFiAccessPoint)
+		accessPoint.AgeSeconds = int32(time.Since(cached.seenAt).Seconds())
+		// The radio is in AP mode, so it can't be associated with any of these
+		accessPoint.IsConnected = false
+		deviceScan.accessPoints = append(deviceScan.accessPoints, accessPoint)
+	}
+
+	return deviceScan
+}
+
+// store keeps the access points of every successful scan in deviceScans. Call it before mergeDeviceScans, which
+// modifies them.
+func (c *ScanCache) store(deviceScans []deviceScan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, deviceScan := range deviceScans {
+		if deviceScan.err != nil {
+			continue
+		}
+		if c.accessPoints[deviceScan.interfaceName] == nil {
+			c.accessPoints[deviceScan.interfaceName] = map[string]cachedAccessPoint{}
+		}
+		for _, accessPoint := range deviceScan.accessPoints {
+			c.accessPoints[deviceScan.interfaceName][accessPoint.BSSID] = cachedAccessPoint{
+				accessPoint: proto.Clone(accessPoint).(*dev.WiFiAccessPoint),
+				seenAt:      now,
+			}
+		}
+	}
+
+	for interfaceName, accessPoints := range c.accessPoints {
+		for bssid, cached := range accessPoints {
+			if now.Sub(cached.seenAt) > scanCacheExpiry {
+				delete(accessPoints, bssid)
+			}
+		}
+		if len(accessPoints) == 0 {
+			delete(c.accessPoints, interfaceName)
+		}
+	}
+}
+
+// cycleHotspotAndScan deactivates the hotspots on apDevices, scans on them and stationDevices, then reactivates the
+// hotspots, even when the scan failed. Clients connected to the hotspots get dropped.
+func (c *ScanCache) cycleHotspotAndScan(ctx context.Context, stationDevices []wifiDevice, apDevices []wifiDevice) ([]deviceScan, error) {
+	nm := nmConn(c.conn)
+	for _, d := range apDevices {
+		activeConnProp, err := d.object(c.conn).GetProperty("org.freedesktop.NetworkManager.Device.ActiveConnection")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get active connection: %v", err)
+		}
+		activeConnPath := activeConnProp.Value().(dbus.ObjectPath)
+
+		connProp, err := c.conn.Object(serviceName, activeConnPath).GetProperty("org.freedesktop.NetworkManager.Connection.Active.Connection")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hotspot connection: %v", err)
+		}
+		hotspotConnPath := connProp.Value().(dbus.ObjectPath)
+
+		log.Printf("Taking hotspot on %s down to scan", d.interfaceName)
+		if err := nm.CallWithContext(ctx, "org.freedesktop.NetworkManager.DeactivateConnection", 0, activeConnPath).Err; err != nil {
+			return nil, fmt.Errorf("failed to deactivate hotspot: %v", err)
+		}
+
+		defer func() {
+			log.Printf("Bringing hotspot on %s back up", d.interfaceName)
+			// ctx may have expired during the scan, and the hotspot has to come back regardless
+			if err := nm.Call("org.freedesktop.NetworkManager.ActivateConnection", 0, hotspotConnPath, d.path, dbus.ObjectPath("/")).Err; err != nil {
+				log.Printf("Failed to reactivate hotspot on %s: %v", d.interfaceName, err)
+			}
+		}()
+
+		if err := waitForStationMode(ctx, d.object(c.conn)); err != nil {
+			return nil, err
+		}
+	}
+
+	return scanDevices(ctx, c.conn, append(append([]wifiDevice{}, stationDevices...), apDevices...)), nil
+}
+
+// devicesByMode splits the matching Wi-Fi devices into those that can scan and those serving a hotspot (AP mode)
+func devicesByMode(ctx context.Context, conn *dbus.Conn, networkInterfaceName string) (stationDevices []wifiDevice, apDevices []wifiDevice, err error) {
+	devices, err := findWifiDevices(ctx, conn, networkInterfaceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, d := range devices {
+		mode, err := deviceWirelessMode(d.object(conn))
+		if err != nil {
+			return nil, nil, err
+		}
+		if mode == NM_802_11_MODE_AP {
+			apDevices = append(apDevices, d)
+		} else {
+			stationDevices = append(stationDevices, d)
+		}
+	}
+
+	return stationDevices, apDevices, nil
+}
+
+func deviceWirelessMode(device dbus.BusObject) (uint32, error) {
+	mode, err := device.GetProperty("org.freedesktop.NetworkManager.Device.Wireless.Mode")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get wireless mode: %v", err)
+	}
+
+	return mode.Value().(uint32), nil
+}
+
+func waitForStationMode(ctx context.Context, device dbus.BusObject) error {
+	waitCtx, cancel := context.WithTimeout(ctx, hotspotDownTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-waitCtx.Done():
+			return fmt.Errorf("radio did not leave AP mode in time")
+		case <-ticker.C:
+			mode, err := deviceWirelessMode(device)
+			if err != nil {
+				return err
+			}
+			if mode != NM_802_11_MODE_AP {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// ValidateScanOptions checks the filtering/grouping options of a scan request
+func ValidateScanOptions(request *dev.WiFiScanRequest) error {
+	if request.MinRssiDbm > 0 {
+		return fmt.Errorf("min_rssi_dbm must be a negative dBm value, got %d", request.MinRssiDbm)
+	}
+	if request.Limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", request.Limit)
+	}
+	if _, ok := dev.WiFiScanSortOrder_name[int32(request.SortOrder)]; !ok {
+		return fmt.Errorf("unknown sort_order %d", request.SortOrder)
+	}
+
+	return nil
+}
+
+// ApplyScanOptions filters, sorts, groups and limits scanResult in place according to request
+func ApplyScanOptions(scanResult *dev.WiFiScanResult, request *dev.WiFiScanRequest) {
+	allowedSecurity := map[dev.WiFiSecurityType]bool{}
+	for _, securityType := range request.SecurityTypes {
+		allowedSecurity[securityType] = true
+	}
+	allowedBands := map[dev.WiFiBand]bool{}
+	for _, band := range request.Bands {
+		allowedBands[band] = true
+	}
+
+	accessPoints := make([]*dev.WiFiAccessPoint, 0, len(scanResult.AccessPoints))
+	for _, ap := range scanResult.AccessPoints {
+		if request.MinRssiDbm != 0 && ap.RssiDbm < request.MinRssiDbm {
+			continue
+		}
+		if len(allowedSecurity) > 0 && !allowedSecurity[ap.SecurityType] {
+			continue
+		}
+		if len(allowedBands) > 0 && !allowedBands[ap.Band] {
+			continue
+		}
+		if request.HideHidden && ap.SSID == "" {
+			continue
+		}
+		accessPoints = append(accessPoints, ap)
+	}
+
+	sortAccessPoints(accessPoints, request.SortOrder)
+
+	if !request.GroupBySsid {
+		if request.Limit > 0 && len(accessPoints) > int(request.Limit) {
+			accessPoints = accessPoints[:request.Limit]
+		}
+		scanResult.AccessPoints = accessPoints
+		return
+	}
+
+	networks := groupBySSID(accessPoints)
+	sortNetworks(networks, request.SortOrder)
+	if request.Limit > 0 && len(networks) > int(request.Limit) {
+		networks = networks[:request.Limit]
+	}
+	scanResult.Networks = networks
+	scanResult.AccessPoints = nil
+}
+
+func sortAccessPoints(accessPoints []*dev.WiFiAccessPoint, sortOrder dev.WiFiScanSortOrder) {
+	switch sortOrder {
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL:
+		sort.SliceStable(accessPoints, func(i, j int) bool {
+			return accessPoints[i].RssiDbm > accessPoints[j].RssiDbm
+		})
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SSID:
+		sort.SliceStable(accessPoints, func(i, j int) bool {
+			return accessPoints[i].SSID < accessPoints[j].SSID
+		})
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_FREQUENCY:
+		sort.SliceStable(accessPoints, func(i, j int) bool {
+			return accessPoints[i].Frequency < accessPoints[j].Frequency
+		})
+	}
+}
+
+// groupBySSID collects access points into one network per SSID, keeping the order in which SSIDs first appear.
+// Hidden access points have no SSID to group on, so each becomes its own network.
+func groupBySSID(accessPoints []*dev.WiFiAccessPoint) []*dev.WiFiNetwork {
+	networks := []*dev.WiFiNetwork{}
+	bySSID := map[string]*dev.WiFiNetwork{}
+
+	for _, ap := range accessPoints {
+		network, ok := bySSID[ap.SSID]
+		if !ok || ap.SSID == "" {
+			network = &dev.WiFiNetwork{
+				SSID: ap.SSID,
+			}
+			networks = append(networks, network)
+			if ap.SSID != "" {
+				bySSID[ap.SSID] = network
+			}
+		}
+		network.AccessPoints = append(network.AccessPoints, ap)
+	}
+
+	for _, network := range networks {
+		sortAccessPoints(network.AccessPoints, dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL)
+
+		best := network.AccessPoints[0]
+		network.SecurityType = best.SecurityType
+		network.BestRssiDbm = best.RssiDbm
+		network.SignalRating = best.SignalRating
+		network.IsSaved = best.IsSaved
+		network.SavedConnectionUuid = best.SavedConnectionUuid
+		for _, ap := range network.AccessPoints {
+			network.IsConnected = network.IsConnected || ap.IsConnected
+		}
+	}
+
+	return networks
+}
+
+func sortNetworks(networks []*dev.WiFiNetwork, sortOrder dev.WiFiScanSortOrder) {
+	switch sortOrder {
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL:
+		sort.SliceStable(networks, func(i, j int) bool {
+			return networks[i].BestRssiDbm > networks[j].BestRssiDbm
+		})
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SSID:
+		sort.SliceStable(networks, func(i, j int) bool {
+			return networks[i].SSID < networks[j].SSID
+		})
+	case dev.WiFiScanSortOrder_WIFI_SCAN_SORT_FREQUENCY:
+		sort.SliceStable(networks, func(i, j int) bool {
+			return networks[i].AccessPoints[0].Frequency < networks[j].AccessPoints[0].Frequency
+		})
+	}
+}
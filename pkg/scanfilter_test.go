@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// scanFixture is a fresh scan result on every call, since ApplyScanOptions works in place
+func scanFixture() *dev.WiFiScanResult {
+	return &dev.WiFiScanResult{
+		AccessPoints: []*dev.WiFiAccessPoint{
+			{BSSID: "00:00:00:00:00:01", SSID: "office", RssiDbm: -70, Frequency: 2412, Band: dev.WiFiBand_WIFI_BAND_2_4_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK},
+			{BSSID: "00:00:00:00:00:02", SSID: "office", RssiDbm: -50, Frequency: 5180, Band: dev.WiFiBand_WIFI_BAND_5_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK, IsConnected: true},
+			{BSSID: "00:00:00:00:00:03", SSID: "guest", RssiDbm: -60, Frequency: 2437, Band: dev.WiFiBand_WIFI_BAND_2_4_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_OPEN},
+			{BSSID: "00:00:00:00:00:04", SSID: "", RssiDbm: -40, Frequency: 5500, Band: dev.WiFiBand_WIFI_BAND_5_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_WPA2_EAP},
+			{BSSID: "00:00:00:00:00:05", SSID: "", RssiDbm: -80, Frequency: 2462, Band: dev.WiFiBand_WIFI_BAND_2_4_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK},
+			{BSSID: "00:00:00:00:00:06", SSID: "lab", RssiDbm: -90, Frequency: 5745, Band: dev.WiFiBand_WIFI_BAND_5_GHZ, SecurityType: dev.WiFiSecurityType_WIFI_SECURITY_WPA3_PSK},
+		},
+	}
+}
+
+func TestValidateScanOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *dev.WiFiScanRequest
+		wantErr bool
+	}{
+		{"defaults", &dev.WiFiScanRequest{}, false},
+		{"negative min_rssi_dbm", &dev.WiFiScanRequest{MinRssiDbm: -70}, false},
+		{"positive min_rssi_dbm", &dev.WiFiScanRequest{MinRssiDbm: 70}, true},
+		{"negative limit", &dev.WiFiScanRequest{Limit: -1}, true},
+		{"unknown sort order", &dev.WiFiScanRequest{SortOrder: dev.WiFiScanSortOrder(99)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateScanOptions(tt.request); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateScanOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyScanOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *dev.WiFiScanRequest
+		// BSSIDs, by their last digit, in order
+		want []string
+	}{
+		{
+			name:    "no options",
+			request: &dev.WiFiScanRequest{},
+			want:    []string{"1", "2", "3", "4", "5", "6"},
+		},
+		{
+			name:    "min rssi is inclusive",
+			request: &dev.WiFiScanRequest{MinRssiDbm: -60},
+			want:    []string{"2", "3", "4"},
+		},
+		{
+			name:    "security types",
+			request: &dev.WiFiScanRequest{SecurityTypes: []dev.WiFiSecurityType{dev.WiFiSecurityType_WIFI_SECURITY_OPEN, dev.WiFiSecurityType_WIFI_SECURITY_WPA3_PSK}},
+			want:    []string{"3", "6"},
+		},
+		{
+			name:    "bands",
+			request: &dev.WiFiScanRequest{Bands: []dev.WiFiBand{dev.WiFiBand_WIFI_BAND_5_GHZ}},
+			want:    []string{"2", "4", "6"},
+		},
+		{
+			name:    "hide hidden",
+			request: &dev.WiFiScanRequest{HideHidden: true},
+			want:    []string{"1", "2", "3", "6"},
+		},
+		{
+			name:    "sort by signal",
+			request: &dev.WiFiScanRequest{SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL},
+			want:    []string{"4", "2", "3", "1", "5", "6"},
+		},
+		{
+			name:    "sort by SSID keeps scan order for equal SSIDs",
+			request: &dev.WiFiScanRequest{SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SSID},
+			want:    []string{"4", "5", "3", "6", "1", "2"},
+		},
+		{
+			name:    "sort by frequency",
+			request: &dev.WiFiScanRequest{SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_FREQUENCY},
+			want:    []string{"1", "3", "5", "2", "4", "6"},
+		},
+		{
+			name:    "limit applies after filtering and sorting",
+			request: &dev.WiFiScanRequest{HideHidden: true, SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL, Limit: 2},
+			want:    []string{"2", "3"},
+		},
+		{
+			name:    "limit above the number of access points",
+			request: &dev.WiFiScanRequest{Limit: 10},
+			want:    []string{"1", "2", "3", "4", "5", "6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanResult := scanFixture()
+			ApplyScanOptions(scanResult, tt.request)
+
+			var got []string
+			for _, ap := range scanResult.AccessPoints {
+				got = append(got, ap.BSSID[len(ap.BSSID)-1:])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("access points = %v, want %v", got, tt.want)
+			}
+			if scanResult.Networks != nil {
+				t.Errorf("networks = %v, want none without group_by_ssid", scanResult.Networks)
+			}
+		})
+	}
+}
+
+func TestApplyScanOptionsGroupBySSID(t *testing.T) {
+	type network struct {
+		ssid         string
+		bestRssiDbm  int32
+		isConnected  bool
+		accessPoints int
+	}
+
+	tests := []struct {
+		name    string
+		request *dev.WiFiScanRequest
+		want    []network
+	}{
+		{
+			name:    "keeps first appearance order, hidden access points each on their own",
+			request: &dev.WiFiScanRequest{GroupBySsid: true},
+			want: []network{
+				{"office", -50, true, 2},
+				{"guest", -60, false, 1},
+				{"", -40, false, 1},
+				{"", -80, false, 1},
+				{"lab", -90, false, 1},
+			},
+		},
+		{
+			name:    "sorted by best signal and limited",
+			request: &dev.WiFiScanRequest{GroupBySsid: true, HideHidden: true, SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SIGNAL, Limit: 2},
+			want: []network{
+				{"office", -50, true, 2},
+				{"guest", -60, false, 1},
+			},
+		},
+		{
+			name:    "filters apply to the access points before grouping",
+			request: &dev.WiFiScanRequest{GroupBySsid: true, Bands: []dev.WiFiBand{dev.WiFiBand_WIFI_BAND_2_4_GHZ}, HideHidden: true},
+			want: []network{
+				{"office", -70, false, 1},
+				{"guest", -60, false, 1},
+			},
+		},
+		{
+			name:    "sorted by SSID",
+			request: &dev.WiFiScanRequest{GroupBySsid: true, HideHidden: true, SortOrder: dev.WiFiScanSortOrder_WIFI_SCAN_SORT_SSID},
+			want: []network{
+				{"guest", -60, false, 1},
+				{"lab", -90, false, 1},
+				{"office", -50, true, 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanResult := scanFixture()
+			ApplyScanOptions(scanResult, tt.request)
+
+			if scanResult.AccessPoints != nil {
+				t.Errorf("access points = %v, want none with group_by_ssid", scanResult.AccessPoints)
+			}
+			if len(scanResult.Networks) != len(tt.want) {
+				t.Fatalf("got %d networks, want %d", len(scanResult.Networks), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := scanResult.Networks[i]
+				if got.SSID != want.ssid || got.BestRssiDbm != want.bestRssiDbm || got.IsConnected != want.isConnected || len(got.AccessPoints) != want.accessPoints {
+					t.Errorf("network %d = %q (best %d dBm, connected %v, %d access points), want %q (best %d dBm, connected %v, %d access points)",
+						i, got.SSID, got.BestRssiDbm, got.IsConnected, len(got.AccessPoints), want.ssid, want.bestRssiDbm, want.isConnected, want.accessPoints)
+				}
+				// The strongest access point comes first within a network
+				for j := 1; j < len(got.AccessPoints); j++ {
+					if got.AccessPoints[j].RssiDbm > got.AccessPoints[j-1].RssiDbm {
+						t.Errorf("network %q access points aren't sorted by signal", got.SSID)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NMSettingSecretFlags values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_SETTING_SECRET_FLAG_NONE         = 0x0
+	NM_SETTING_SECRET_FLAG_AGENT_OWNED  = 0x1
+	NM_SETTING_SECRET_FLAG_NOT_SAVED    = 0x2
+	NM_SETTING_SECRET_FLAG_NOT_REQUIRED = 0x4
+)
+
+// NMSecretAgentGetSecretsFlags values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_SECRET_AGENT_GET_SECRETS_FLAG_NONE              = 0x0
+	NM_SECRET_AGENT_GET_SECRETS_FLAG_ALLOW_INTERACTION = 0x1
+	NM_SECRET_AGENT_GET_SECRETS_FLAG_REQUEST_NEW       = 0x2
+	NM_SECRET_AGENT_GET_SECRETS_FLAG_USER_REQUESTED    = 0x4
+)
+
+const (
+	secretAgentIdentifier = "com.uinta-labs.iotnetlab"
+	secretAgentInterface  = "org.freedesktop.NetworkManager.SecretAgent"
+	secretAgentObjPath    = dbus.ObjectPath("/org/freedesktop/NetworkManager/SecretAgent")
+	agentManagerObjPath   = dbus.ObjectPath("/org/freedesktop/NetworkManager/AgentManager")
+)
+
+// agentOwnedSecrets lists, per setting, the secrets handed to the secret agent instead of NM's keyfiles, and the
+// flags property of each
+var agentOwnedSecrets = map[string]map[string]string{
+	"802-11-wireless-security": {
+		"psk":           "psk-flags",
+		"wep-key0":      "wep-key-flags",
+		"wep-key1":      "wep-key-flags",
+		"wep-key2":      "wep-key-flags",
+		"wep-key3":      "wep-key-flags",
+		"leap-password": "leap-password-flags",
+	},
+	"802-1x": {
+		"password":                    "password-flags",
+		"private-key-password":        "private-key-password-flags",
+		"phase2-private-key-password": "phase2-private-key-password-flags",
+		"pin":                         "pin-flags",
+	},
+}
+
+// RegisterSecretAgent registers iotnetlab as NM's secret agent, answering GetSecrets from store. Profiles created
+// with the same store mark their secrets agent-owned, which keeps them out of /etc/NetworkManager/system-connections.
+// The agent re-registers whenever NetworkManager restarts, until ctx is done.
+func RegisterSecretAgent(ctx context.Context, conn *dbus.Conn, store *SecretStore) error {
+	agent := &secretAgent{
+		conn:  conn,
+		store: store,
+	}
+	if err := conn.Export(agent, secretAgentObjPath, secretAgentInterface); err != nil {
+		return fmt.Errorf("failed to export secret agent: %v", err)
+	}
+
+	// Watch for restarts before registering, so one can't slip in between
+	matchRule := []dbus.MatchOption{
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, serviceName),
+	}
+	if err := conn.AddMatchSignalContext(ctx, matchRule...); err != nil {
+		return fmt.Errorf("failed to add signal match: %v", err)
+	}
+	sigChan := make(chan *dbus.Signal, 10)
+	conn.Signal(sigChan)
+
+	if err := registerSecretAgent(ctx, conn); err != nil {
+		conn.RemoveSignal(sigChan)
+		conn.RemoveMatchSignal(matchRule...)
+		return err
+	}
+
+	go func() {
+		defer conn.RemoveMatchSignal(matchRule...)
+		defer conn.RemoveSignal(sigChan)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig, ok := <-sigChan:
+				if !ok {
+					return
+				}
+				if sig.Name != "org.freedesktop.DBus.NameOwnerChanged" {
+					continue
+				}
+				var name, oldOwner, newOwner string
+				if err := dbus.Store(sig.Body, &name, &oldOwner, &newOwner); err != nil || name != serviceName || newOwner == "" {
+					continue
+				}
+				log.Printf("NetworkManager restarted, registering the secret agent again")
+				if err := registerSecretAgent(ctx, conn); err != nil {
+					log.Printf("Failed to register secret agent: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func registerSecretAgent(ctx context.Context, conn *dbus.Conn) error {
+	agentManager := conn.Object(serviceName, agentManagerObjPath)
+	if err := agentManager.CallWithContext(ctx, "org.freedesktop.NetworkManager.AgentManager.Register", 0, secretAgentIdentifier).Err; err != nil {
+		return fmt.Errorf("failed to register secret agent: %v", err)
+	}
+
+	return nil
+}
+
+// takeAgentSecrets moves the secrets out of connection and marks them agent-owned, returning them for
+// storeAgentSecrets. Without a store (no secret agent) connection is left alone, so NM gets the secrets inline, and
+// nil is returned.
+func takeAgentSecrets(store *SecretStore, connection map[string]map[string]dbus.Variant) map[string]map[string]string {
+	if store == nil {
+		return nil
+	}
+
+	secrets := map[string]map[string]string{}
+	for settingName, secretFlags := range agentOwnedSecrets {
+		for key, flagsKey := range secretFlags {
+			value, ok := connection[settingName][key].Value().(string)
+			if !ok {
+				continue
+			}
+			if secrets[settingName] == nil {
+				secrets[settingName] = map[string]string{}
+			}
+			secrets[settingName][key] = value
+			delete(connection[settingName], key)
+			connection[settingName][flagsKey] = dbus.MakeVariant(uint32(NM_SETTING_SECRET_FLAG_AGENT_OWNED))
+		}
+	}
+
+	return secrets
+}
+
+// storeAgentSecrets keeps secrets from takeAgentSecrets in store for the profile uuid
+func storeAgentSecrets(store *SecretStore, uuid string, secrets map[string]map[string]string) error {
+	if store == nil || len(secrets) == 0 {
+		return nil
+	}
+
+	if err := store.Put(uuid, secrets); err != nil {
+		return fmt.Errorf("failed to store secrets: %v", err)
+	}
+
+	return nil
+}
+
+// forgetAgentSecrets drops whatever store holds for the profile uuid. It's called on failure paths, so errors are
+// only logged.
+func forgetAgentSecrets(store *SecretStore, uuid string) {
+	if store == nil {
+		return
+	}
+
+	if err := store.Delete(uuid); err != nil {
+		log.Printf("Failed to delete stored secrets of connection %s: %v", uuid, err)
+	}
+}
+
+// newConnectionUUID generates a (version 4) UUID for a profile, so its secrets can be stored before NM has seen it
+func newConnectionUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// secretAgent implements org.freedesktop.NetworkManager.SecretAgent. Only its D-Bus methods are exported.
+type secretAgent struct {
+	conn  *dbus.Conn
+	store *SecretStore
+}
+
+func secretAgentError(name string, message string) *dbus.Error {
+	return dbus.NewError(secretAgentInterface+"."+name, []interface{}{message})
+}
+
+// fromNetworkManager checks a call came from NetworkManager; anyone on the system bus can call the agent
+func (a *secretAgent) fromNetworkManager(sender dbus.Sender) *dbus.Error {
+	var owner string
+	if err := a.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, serviceName).Store(&owner); err != nil {
+		return secretAgentError("Failed", fmt.Sprintf("failed to look up NetworkManager: %v", err))
+	}
+	if string(sender) != owner {
+		log.Printf("Refusing secret agent call from %s", sender)
+		return secretAgentError("PermissionDenied", "only NetworkManager may call the secret agent")
+	}
+
+	return nil
+}
+
+func (a *secretAgent) GetSecrets(sender dbus.Sender, connection map[string]map[string]dbus.Variant, connPath dbus.ObjectPath, settingName string, hints []string, flags uint32) (map[string]map[string]dbus.Variant, *dbus.Error) {
+	if err := a.fromNetworkManager(sender); err != nil {
+		return nil, err
+	}
+
+	uuid, _ := connection["connection"]["uuid"].Value().(string)
+	// NM asks for new secrets after the stored ones were rejected; handing them out again would only fail again
+	if flags&NM_SECRET_AGENT_GET_SECRETS_FLAG_REQUEST_NEW != 0 {
+		log.Printf("Stored %s secrets of %s (%s) were rejected", settingName, uuid, connPath)
+		return nil, secretAgentError("NoSecrets", "the stored secrets were rejected")
+	}
+
+	secrets := a.store.Get(uuid, settingName)
+	if len(secrets) == 0 {
+		return nil, secretAgentError("NoSecrets", fmt.Sprintf("no %s secrets stored for %s", settingName, uuid))
+	}
+
+	values := map[string]dbus.Variant{}
+	for key, value := range secrets {
+		values[key] = dbus.MakeVariant(value)
+	}
+
+	return map[string]map[string]dbus.Variant{
+		settingName: values,
+	}, nil
+}
+
+func (a *secretAgent) CancelGetSecrets(sender dbus.Sender, connPath dbus.ObjectPath, settingName string) *dbus.Error {
+	// GetSecrets answers right away, so there's never anything in flight to cancel
+	return a.fromNetworkManager(sender)
+}
+
+func (a *secretAgent) SaveSecrets(sender dbus.Sender, connection map[string]map[string]dbus.Variant, connPath dbus.ObjectPath) *dbus.Error {
+	if err := a.fromNetworkManager(sender); err != nil {
+		return err
+	}
+
+	uuid, _ := connection["connection"]["uuid"].Value().(string)
+	secrets := map[string]map[string]string{}
+	for settingName, secretFlags := range agentOwnedSecrets {
+		for key, flagsKey := range secretFlags {
+			value, ok := connection[settingName][key].Value().(string)
+			if !ok {
+				continue
+			}
+			if flags, _ := connection[settingName][flagsKey].Value().(uint32); flags&NM_SETTING_SECRET_FLAG_AGENT_OWNED == 0 {
+				continue
+			}
+			if secrets[settingName] == nil {
+				secrets[settingName] = map[string]string{}
+			}
+			secrets[settingName][key] = value
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil
+	}
+	if err := a.store.Put(uuid, secrets); err != nil {
+		return secretAgentError("Failed", err.Error())
+	}
+
+	return nil
+}
+
+func (a *secretAgent) DeleteSecrets(sender dbus.Sender, connection map[string]map[string]dbus.Variant, connPath dbus.ObjectPath) *dbus.Error {
+	if err := a.fromNetworkManager(sender); err != nil {
+		return err
+	}
+
+	uuid, _ := connection["connection"]["uuid"].Value().(string)
+	if err := a.store.Delete(uuid); err != nil {
+		return secretAgentError("Failed", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// secretKeySize is the size of the AES-256 key protecting the secret store
+const secretKeySize = 32
+
+// SecretStore keeps connection secrets (passwords, PSKs) encrypted at rest, keyed by connection UUID and then by
+// setting and secret name. The key lives in a separate file that has to be provisioned off the device image (e.g.
+// on a secure element or a partition that isn't dumped with it); a key generated next to the store would protect
+// nothing.
+type SecretStore struct {
+	mu      sync.Mutex
+	path    string
+	aead    cipher.AEAD
+	secrets map[string]map[string]map[string]string
+}
+
+// OpenSecretStore loads the store at path, encrypted with the key in keyFile. The key file has to exist; a missing
+// store starts out empty.
+func OpenSecretStore(path string, keyFile string) (*SecretStore, error) {
+	if keyFile == "" {
+		return nil, errors.New("a secret key file is required")
+	}
+	key, err := readSecretKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	s := &SecretStore{
+		path:    path,
+		aead:    aead,
+		secrets: map[string]map[string]map[string]string{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Get returns the secrets stored for settingName of connection uuid
+func (s *SecretStore) Get(uuid string, settingName string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secrets := map[string]string{}
+	for key, value := range s.secrets[uuid][settingName] {
+		secrets[key] = value
+	}
+
+	return secrets
+}
+
+// Put stores secrets (by setting name) for connection uuid, replacing what was stored for those settings
+func (s *SecretStore) Put(uuid string, secrets map[string]map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.secrets[uuid] == nil {
+		s.secrets[uuid] = map[string]map[string]string{}
+	}
+	for settingName, values := range secrets {
+		s.secrets[uuid][settingName] = values
+	}
+
+	return s.save()
+}
+
+// Delete forgets the secrets of connection uuid
+func (s *SecretStore) Delete(uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.secrets[uuid]; !ok {
+		return nil
+	}
+	delete(s.secrets, uuid)
+
+	return s.save()
+}
+
+func (s *SecretStore) load() error {
+	sealed, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read secret store: %v", err)
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return fmt.Errorf("secret store %s is truncated", s.path)
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt secret store %s, was the key file replaced? %v", s.path, err)
+	}
+
+	if err := json.Unmarshal(plaintext, &s.secrets); err != nil {
+		return fmt.Errorf("failed to parse secret store: %v", err)
+	}
+
+	return nil
+}
+
+// save writes the store through a temporary file, so a crash never leaves it half written
+func (s *SecretStore) save() error {
+	plaintext, err := json.Marshal(s.secrets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets: %v", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create secret store directory: %v", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write secret store: %v", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace secret store: %v", err)
+	}
+
+	return nil
+}
+
+// readSecretKey reads a key of secretKeySize raw bytes or hex digits (e.g. from `openssl rand -hex 32`)
+func readSecretKey(keyFile string) ([]byte, error) {
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret key: %v", err)
+	}
+
+	if len(contents) == secretKeySize {
+		return contents, nil
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(contents))); err == nil && len(key) == secretKeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("secret key %s must be %d bytes, or %d hex digits", keyFile, secretKeySize, 2*secretKeySize)
+}
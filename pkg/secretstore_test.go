@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSecretKey writes contents as a key file into dir and returns its path
+func writeSecretKey(t *testing.T, dir string, contents []byte) string {
+	t.Helper()
+
+	keyFile := filepath.Join(dir, "secret.key")
+	if err := os.WriteFile(keyFile, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyFile
+}
+
+func TestSecretStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := writeSecretKey(t, dir, bytes.Repeat([]byte{0x42}, secretKeySize))
+	path := filepath.Join(dir, "store", "secrets")
+
+	store, err := OpenSecretStore(path, keyFile)
+	if err != nil {
+		t.Fatalf("OpenSecretStore() error = %v", err)
+	}
+	psk := map[string]string{"psk": "correct horse battery staple"}
+	if err := store.Put("uuid-1", map[string]map[string]string{"802-11-wireless-security": psk}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte(psk["psk"])) {
+		t.Errorf("store file contains the secret in plain text")
+	}
+
+	reopened, err := OpenSecretStore(path, keyFile)
+	if err != nil {
+		t.Fatalf("reopening the store: %v", err)
+	}
+	if got := reopened.Get("uuid-1", "802-11-wireless-security"); !maps.Equal(got, psk) {
+		t.Errorf("Get() = %v, want %v", got, psk)
+	}
+	if got := reopened.Get("uuid-2", "802-11-wireless-security"); len(got) != 0 {
+		t.Errorf("Get() of an unknown connection = %v, want nothing", got)
+	}
+}
+
+func TestSecretStoreTampering(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := writeSecretKey(t, dir, bytes.Repeat([]byte{0x42}, secretKeySize))
+	path := filepath.Join(dir, "secrets")
+
+	store, err := OpenSecretStore(path, keyFile)
+	if err != nil {
+		t.Fatalf("OpenSecretStore() error = %v", err)
+	}
+	if err := store.Put("uuid-1", map[string]map[string]string{"802-1x": {"password": "hunter2"}}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		key    []byte
+	}{
+		{"flipped ciphertext byte", flipByte(sealed, len(sealed)-1), nil},
+		{"flipped nonce byte", flipByte(sealed, 0), nil},
+		{"truncated", sealed[:4], nil},
+		{"other key", sealed, bytes.Repeat([]byte{0x24}, secretKeySize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "secrets")
+			if err := os.WriteFile(path, tt.sealed, 0600); err != nil {
+				t.Fatal(err)
+			}
+			keyFile := keyFile
+			if tt.key != nil {
+				keyFile = writeSecretKey(t, dir, tt.key)
+			}
+
+			if _, err := OpenSecretStore(path, keyFile); err == nil {
+				t.Errorf("OpenSecretStore() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// flipByte returns a copy of b with the bits of the byte at i inverted
+func flipByte(b []byte, i int) []byte {
+	b = bytes.Clone(b)
+	b[i] ^= 0xff
+
+	return b
+}
+
+func TestSecretStoreKeyFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, secretKeySize)
+
+	tests := []struct {
+		name    string
+		key     []byte // nil for no key file at all
+		wantErr bool
+	}{
+		{"raw key", key, false},
+		{"hex key", []byte(hex.EncodeToString(key)), false},
+		{"hex key with newline", []byte(hex.EncodeToString(key) + "\n"), false},
+		{"missing", nil, true},
+		{"empty", []byte{}, true},
+		{"short raw key", key[:16], true},
+		{"short hex key", []byte(hex.EncodeToString(key[:20])), true},
+		{"long raw key", append(bytes.Clone(key), 0x42), true},
+		{"not hex", []byte(strings.Repeat("zz", secretKeySize)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keyFile := filepath.Join(dir, "secret.key")
+			if tt.key != nil {
+				keyFile = writeSecretKey(t, dir, tt.key)
+			}
+
+			_, err := OpenSecretStore(filepath.Join(dir, "secrets"), keyFile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("OpenSecretStore() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := OpenSecretStore(filepath.Join(t.TempDir(), "secrets"), ""); err == nil {
+		t.Errorf("OpenSecretStore() without a key file succeeded, want an error")
+	}
+}
+
+func TestSecretStoreRewrite(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := writeSecretKey(t, dir, bytes.Repeat([]byte{0x42}, secretKeySize))
+	path := filepath.Join(dir, "secrets")
+
+	store, err := OpenSecretStore(path, keyFile)
+	if err != nil {
+		t.Fatalf("OpenSecretStore() error = %v", err)
+	}
+	if err := store.Put("uuid-1", map[string]map[string]string{"802-11-wireless-security": {"psk": "password1"}}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	first, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("uuid-2", map[string]map[string]string{"802-11-wireless-security": {"psk": "password2"}}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := store.Delete("uuid-1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	second, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("store file wasn't rewritten")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("store file mode = %v, want 0600", perm)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+
+	reopened, err := OpenSecretStore(path, keyFile)
+	if err != nil {
+		t.Fatalf("reopening the store: %v", err)
+	}
+	if got := reopened.Get("uuid-1", "802-11-wireless-security"); len(got) != 0 {
+		t.Errorf("deleted secrets came back: %v", got)
+	}
+	if got := reopened.Get("uuid-2", "802-11-wireless-security"); got["psk"] != "password2" {
+		t.Errorf("Get() = %v, want psk password2", got)
+	}
+}
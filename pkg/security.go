@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// NMWepKeyType values
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_WEP_KEY_TYPE_KEY        = 1 // 5/13 ASCII characters or 10/26 hex digits
+	NM_WEP_KEY_TYPE_PASSPHRASE = 2 // hashed into a 104-bit key
+)
+
+// hiddenProbeTimeout bounds the directed scan for a hidden network
+const hiddenProbeTimeout = 10 * time.Second
+
+var ErrInvalidConnectOptions = errors.New("invalid connect options")
+
+// keyManagementSecrets maps each key management to the kind of secret it needs
+var keyManagementSecrets = map[dev.WiFiKeyManagement]string{
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OPEN:                "is_open",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE:                 "is_open",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:                 "password",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK:             "password",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE:                 "password",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP:             "eap_config",
+	dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192: "eap_config",
+}
+
+// ValidateConnectOptions checks the SSID, secret, key management, BSSID and band of a connect request
+func ValidateConnectOptions(request *dev.WiFiConnectRequest) error {
+	var v violations
+	validateConnectOptions(&v, request)
+
+	return v.err(ErrInvalidConnectOptions)
+}
+
+func validateConnectOptions(v *violations, request *dev.WiFiConnectRequest) {
+	validateSSID(v, "SSID", request.SSID)
+
+	var secret string
+	switch s := request.GetSecret().(type) {
+	case *dev.WiFiConnectRequest_IsOpen:
+		if !s.IsOpen {
+			v.add("is_open", "must be true, as any other condition must be specified instead")
+		}
+		secret = "is_open"
+	case *dev.WiFiConnectRequest_Password:
+		secret = "password"
+		validatePassword(v, "password", request.KeyManagement, s.Password)
+	case *dev.WiFiConnectRequest_EapConfig:
+		secret = "eap_config"
+	default:
+		v.add("secret", "one of is_open, password or eap_config is required")
+	}
+
+	if request.KeyManagement != dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_AUTO {
+		required, ok := keyManagementSecrets[request.KeyManagement]
+		if !ok {
+			v.add("key_management", "unknown key management %d", request.KeyManagement)
+		} else if secret != "" && required != secret {
+			v.add("key_management", "%s needs %s, not %s", request.KeyManagement, required, secret)
+		}
+	}
+
+	if request.BSSID != "" {
+		if _, err := parseBSSID(request.BSSID); err != nil {
+			v.add("BSSID", "%v", err)
+		}
+	}
+
+	switch request.Band {
+	case dev.WiFiBand_WIFI_BAND_UNKNOWN, dev.WiFiBand_WIFI_BAND_2_4_GHZ, dev.WiFiBand_WIFI_BAND_5_GHZ:
+	default:
+		v.add("band", "must be 2.4 or 5 GHz, not %s", request.Band)
+	}
+}
+
+func parseBSSID(bssid string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(bssid)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("BSSID %q is not a MAC address", bssid)
+	}
+
+	return mac, nil
+}
+
+// probeHiddenNetwork requests a scan that actively probes for ssid on d, since a hidden network doesn't show up
+// in a regular (passive) scan
+func probeHiddenNetwork(ctx context.Context, conn *dbus.Conn, d wifiDevice, ssid string) error {
+	scanCtx, cancel := context.WithTimeout(ctx, hiddenProbeTimeout)
+	defer cancel()
+
+	options := map[string]dbus.Variant{
+		"ssids": dbus.MakeVariant([][]byte{[]byte(ssid)}),
+	}
+	_, err := requestScanAndWait(scanCtx, conn, d, options)
+	return err
+}
+
+// detectKeyManagement picks a key management for request from the access points d currently knows about: the
+// strongest one broadcasting request.SSID (and matching the requested BSSID and band) decides. Without a matching
+// access point it falls back to what the kind of secret most likely means.
+func detectKeyManagement(conn *dbus.Conn, d wifiDevice, request *dev.WiFiConnectRequest) dev.WiFiKeyManagement {
+	var pinnedBSSID string
+	if request.BSSID != "" {
+		bssid, _ := parseBSSID(request.BSSID)
+		pinnedBSSID = bssid.String()
+	}
+
+	var best *dev.WiFiAccessPoint
+	if aps, err := deviceAccessPointPaths(conn, d); err == nil {
+		for _, ap := range aps {
+			accessPoint, err := readAccessPoint(conn, d, ap)
+			if err != nil || accessPoint.SSID != request.SSID {
+				continue
+			}
+			if pinnedBSSID != "" {
+				if bssid, err := parseBSSID(accessPoint.BSSID); err != nil || bssid.String() != pinnedBSSID {
+					continue
+				}
+			}
+			if request.Band != dev.WiFiBand_WIFI_BAND_UNKNOWN && accessPoint.Band != request.Band {
+				continue
+			}
+			if best == nil || accessPoint.RssiDbm > best.RssiDbm {
+				best = accessPoint
+			}
+		}
+	}
+
+	var apFlags, wpaFlags, rsnFlags uint32
+	if best != nil {
+		apFlags, wpaFlags, rsnFlags = best.Flags, best.WpaFlags, best.RsnFlags
+	} else {
+		log.Printf("No access point for %q in the scan results, guessing the key management", request.SSID)
+	}
+
+	switch request.GetSecret().(type) {
+	case *dev.WiFiConnectRequest_IsOpen:
+		if rsnFlags&(NM_802_11_AP_SEC_KEY_MGMT_OWE|NM_802_11_AP_SEC_KEY_MGMT_OWE_TM) != 0 {
+			return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE
+		}
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OPEN
+	case *dev.WiFiConnectRequest_EapConfig:
+		if rsnFlags&NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192 != 0 && (wpaFlags|rsnFlags)&NM_802_11_AP_SEC_KEY_MGMT_802_1X == 0 {
+			return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192
+		}
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP
+	}
+
+	// A password. Transition networks also accept PSK, which works with more drivers than SAE does.
+	switch {
+	case (wpaFlags|rsnFlags)&NM_802_11_AP_SEC_KEY_MGMT_PSK != 0:
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK
+	case rsnFlags&NM_802_11_AP_SEC_KEY_MGMT_SAE != 0:
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE
+	case best != nil && determineSecurity(apFlags, wpaFlags, rsnFlags) == dev.WiFiSecurityType_WIFI_SECURITY_WEP:
+		return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP
+	}
+
+	return dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK
+}
+
+// securitySettings builds the NM "802-11-wireless-security" setting for keyManagement; nil for open networks,
+// which have none
+func securitySettings(keyManagement dev.WiFiKeyManagement, password string) map[string]dbus.Variant {
+	switch keyManagement {
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_OWE:
+		return map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("owe"),
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:
+		return map[string]dbus.Variant{
+			"key-mgmt":      dbus.MakeVariant("none"),
+			"auth-alg":      dbus.MakeVariant("open"),
+			"wep-tx-keyidx": dbus.MakeVariant(uint32(0)),
+			"wep-key0":      dbus.MakeVariant(password),
+			"wep-key-type":  dbus.MakeVariant(wepKeyType(password)),
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK:
+		return map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("wpa-psk"),
+			"psk":      dbus.MakeVariant(password),
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE:
+		return map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("sae"),
+			"psk":      dbus.MakeVariant(password),
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP:
+		return map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("wpa-eap"),
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_EAP_SUITE_B_192:
+		return map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("wpa-eap-suite-b-192"),
+		}
+	}
+
+	return nil
+}
+
+// wepKeyType tells NM how to take the WEP key key: the lengths of 40 and 104-bit keys (5 or 13 characters, 10 or 26
+// hex digits) are the key itself, anything else is a passphrase NM hashes into one. A 10 or 26 character key is a
+// hex key even when it isn't valid hex, which wepKeyProblem rejects, rather than a passphrase.
+func wepKeyType(key string) uint32 {
+	switch len(key) {
+	case 5, 10, 13, 26:
+		return NM_WEP_KEY_TYPE_KEY
+	}
+
+	return NM_WEP_KEY_TYPE_PASSPHRASE
+}
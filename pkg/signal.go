@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	supplicantServiceName = "fi.w1.wpa_supplicant1"
+	supplicantObjPath     = "/fi/w1/wpa_supplicant1"
+
+	// supplicantSignalsTTL bounds how often we walk wpa_supplicant's BSS list; watchers can ask many times a second
+	supplicantSignalsTTL = 2 * time.Second
+)
+
+type cachedSupplicantSignals struct {
+	fetchedAt time.Time
+	signals   map[string]int32
+}
+
+var (
+	supplicantSignalsMu    sync.Mutex
+	supplicantSignalsCache = map[string]cachedSupplicantSignals{}
+)
+
+// supplicantSignals maps (upper-case) BSSID to the signal level in dBm for every BSS wpa_supplicant currently knows
+// on interfaceName. NetworkManager only exposes a 0-100 percentage, so this is where real dBm values come from.
+func supplicantSignals(conn *dbus.Conn, interfaceName string) (map[string]int32, error) {
+	supplicantSignalsMu.Lock()
+	defer supplicantSignalsMu.Unlock()
+
+	if cached, ok := supplicantSignalsCache[interfaceName]; ok && time.Since(cached.fetchedAt) < supplicantSignalsTTL {
+		return cached.signals, nil
+	}
+
+	signals, err := fetchSupplicantSignals(conn, interfaceName)
+
+	// Failures are cached too, so a missing wpa_supplicant D-Bus API doesn't cost a round trip per access point
+	supplicantSignalsCache[interfaceName] = cachedSupplicantSignals{
+		fetchedAt: time.Now(),
+		signals:   signals,
+	}
+
+	return signals, err
+}
+
+func fetchSupplicantSignals(conn *dbus.Conn, interfaceName string) (map[string]int32, error) {
+	supplicant := conn.Object(supplicantServiceName, supplicantObjPath)
+
+	var interfacePath dbus.ObjectPath
+	if err := supplicant.Call("fi.w1.wpa_supplicant1.GetInterface", 0, interfaceName).Store(&interfacePath); err != nil {
+		return map[string]int32{}, fmt.Errorf("failed to get wpa_supplicant interface: %v", err)
+	}
+
+	bssPaths, err := conn.Object(supplicantServiceName, interfacePath).GetProperty("fi.w1.wpa_supplicant1.Interface.BSSs")
+	if err != nil {
+		return map[string]int32{}, fmt.Errorf("failed to get wpa_supplicant BSSs: %v", err)
+	}
+
+	signals := map[string]int32{}
+	for _, bssPath := range bssPaths.Value().([]dbus.ObjectPath) {
+		props, err := getAllProperties(context.Background(), conn.Object(supplicantServiceName, bssPath), "fi.w1.wpa_supplicant1.BSS")
+		if err != nil {
+			continue // BSS expired in the meantime
+		}
+
+		bssid, _ := props["BSSID"].Value().([]byte)
+		signal, ok := props["Signal"].Value().(int16)
+		if len(bssid) != 6 || !ok {
+			continue
+		}
+
+		signals[strings.ToUpper(net.HardwareAddr(bssid).String())] = int32(signal)
+	}
+
+	return signals, nil
+}
+
+// estimateDbm inverts NetworkManager's percentage calculation, which clamps dBm to [-100, -40] and maps that range
+// linearly onto 0-100%. Only used when wpa_supplicant can't tell us the real value.
+func estimateDbm(strengthPercent uint8) int32 {
+	return int32(strengthPercent)*60/100 - 100
+}
+
+// accessPointDbm returns the signal level for bssid in dBm, and whether it had to be estimated from NM's percentage
+func accessPointDbm(conn *dbus.Conn, interfaceName string, bssid string, strengthPercent uint8) (dbm int32, estimated bool) {
+	signals, err := supplicantSignals(conn, interfaceName)
+	if err == nil {
+		if signal, ok := signals[strings.ToUpper(bssid)]; ok {
+			return signal, false
+		}
+	}
+
+	return estimateDbm(strengthPercent), true
+}
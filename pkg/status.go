@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// ActivationTracker records when active connections were activated, which NetworkManager doesn't expose, by
+// following their StateChanged signals. Connections activated before Run started have no record, and aren't seeded
+// from the profile's connection.timestamp either: NM refreshes that periodically while the connection is active, so
+// it doesn't tell when the activation happened.
+type ActivationTracker struct {
+	conn *dbus.Conn
+
+	mu          sync.Mutex
+	activatedAt map[dbus.ObjectPath]time.Time
+}
+
+func NewActivationTracker(conn *dbus.Conn) *ActivationTracker {
+	return &ActivationTracker{
+		conn:        conn,
+		activatedAt: map[dbus.ObjectPath]time.Time{},
+	}
+}
+
+// Run records activations until ctx is done. Start it at boot, before anything gets activated.
+func (t *ActivationTracker) Run(ctx context.Context) {
+	matchRules := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchPathNamespace("/org/freedesktop/NetworkManager/ActiveConnection"),
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Connection.Active"),
+			dbus.WithMatchMember("StateChanged"),
+		},
+		{
+			dbus.WithMatchSender("org.freedesktop.DBus"),
+			dbus.WithMatchInterface("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg(0, serviceName),
+		},
+	}
+	for _, matchRule := range matchRules {
+		if err := t.conn.AddMatchSignalContext(ctx, matchRule...); err != nil {
+			log.Printf("Failed to follow activations, connection uptime won't be known: %v", err)
+			return
+		}
+		defer t.conn.RemoveMatchSignal(matchRule...)
+	}
+
+	sigChan := make(chan *dbus.Signal, 10)
+	t.conn.Signal(sigChan)
+	defer t.conn.RemoveSignal(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig, ok := <-sigChan:
+			if !ok {
+				return
+			}
+			switch sig.Name {
+			case "org.freedesktop.NetworkManager.Connection.Active.StateChanged":
+				var state, reason uint32
+				if err := dbus.Store(sig.Body, &state, &reason); err != nil {
+					continue
+				}
+				t.stateChanged(sig.Path, state, time.Now())
+			case "org.freedesktop.DBus.NameOwnerChanged":
+				// A restarted NetworkManager starts over with new active connections
+				t.mu.Lock()
+				t.activatedAt = map[dbus.ObjectPath]time.Time{}
+				t.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (t *ActivationTracker) stateChanged(activeConnPath dbus.ObjectPath, state uint32, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case NM_ACTIVE_CONNECTION_STATE_ACTIVATED:
+		t.activatedAt[activeConnPath] = now
+	case NM_ACTIVE_CONNECTION_STATE_DEACTIVATED:
+		// NM removes the ActiveConnection once it's deactivated, and never reuses its path
+		delete(t.activatedAt, activeConnPath)
+	}
+}
+
+// Uptime returns how long ago the active connection at activeConnPath was activated, if that was seen
+func (t *ActivationTracker) Uptime(activeConnPath dbus.ObjectPath) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	activatedAt, ok := t.activatedAt[activeConnPath]
+	if !ok {
+		return 0, false
+	}
+
+	return time.Since(activatedAt), true
+}
+
+// WifiStatus reports the connection state of the Wi-Fi device. When no interface is given, the first associated
+// Wi-Fi device wins. The connection uptime comes from activations.
+func WifiStatus(ctx context.Context, conn *dbus.Conn, activations *ActivationTracker, networkInterfaceName string) (*dev.WiFiGetStatusResponse, error) {
+	devices, err := findWifiDevices(ctx, conn, networkInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoWifiDevice
+	}
+
+	for _, d := range devices {
+		status, err := wifiDeviceStatus(ctx, conn, activations, d)
+		if err != nil {
+			return nil, err
+		}
+		if status.Connected {
+			return status, nil
+		}
+	}
+
+	return &dev.WiFiGetStatusResponse{
+		Connected:        false,
+		NetworkInterface: devices[0].interfaceName,
+	}, nil
+}
+
+func wifiDeviceStatus(ctx context.Context, conn *dbus.Conn, activations *ActivationTracker, d wifiDevice) (*dev.WiFiGetStatusResponse, error) {
+	status := &dev.WiFiGetStatusResponse{
+		NetworkInterface: d.interfaceName,
+	}
+
+	deviceProps, err := getAllProperties(ctx, d.object(conn), "org.freedesktop.NetworkManager.Device")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device properties: %v", err)
+	}
+
+	activeConnPath, _ := deviceProps["ActiveConnection"].Value().(dbus.ObjectPath)
+	if activeConnPath == "" || activeConnPath == "/" {
+		return status, nil
+	}
+
+	activeConnProps, err := getAllProperties(ctx, conn.Object(serviceName, activeConnPath), "org.freedesktop.NetworkManager.Connection.Active")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active connection properties: %v", err)
+	}
+	if state, _ := activeConnProps["State"].Value().(uint32); state != NM_ACTIVE_CONNECTION_STATE_ACTIVATED {
+		return status, nil
+	}
+
+	wirelessProps, err := getAllProperties(ctx, d.object(conn), "org.freedesktop.NetworkManager.Device.Wireless")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wireless device properties: %v", err)
+	}
+
+	// An active connection without an access point means we're the access point (hotspot), not a client
+	activeAPPath, _ := wirelessProps["ActiveAccessPoint"].Value().(dbus.ObjectPath)
+	if activeAPPath == "" || activeAPPath == "/" {
+		return status, nil
+	}
+
+	apProps, err := getAllProperties(ctx, conn.Object(serviceName, activeAPPath), "org.freedesktop.NetworkManager.AccessPoint")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access point properties: %v", err)
+	}
+
+	ssid, _ := apProps["Ssid"].Value().([]byte)
+	bssid, _ := apProps["HwAddress"].Value().(string)
+	frequency, _ := apProps["Frequency"].Value().(uint32)
+	strength, _ := apProps["Strength"].Value().(uint8)
+	apFlags, _ := apProps["Flags"].Value().(uint32)
+	wpaFlags, _ := apProps["WpaFlags"].Value().(uint32)
+	rsnFlags, _ := apProps["RsnFlags"].Value().(uint32)
+	bitrate, _ := wirelessProps["Bitrate"].Value().(uint32)
+
+	status.Connected = true
+	status.SSID = string(ssid)
+	status.BSSID = bssid
+	status.RssiDbm, status.RssiEstimated = accessPointDbm(conn, d.interfaceName, bssid, strength)
+	status.RSSI = status.RssiDbm
+	status.SignalPercent = int32(strength)
+	status.SignalRating = rssiToRating(status.RssiDbm)
+	status.Frequency = int32(frequency)
+	status.Band, status.Channel = frequencyToBandChannel(int32(frequency))
+	status.SecurityType = determineSecurity(apFlags, wpaFlags, rsnFlags)
+	status.BitrateKbps = int32(bitrate)
+	if uptime, ok := activations.Uptime(activeConnPath); ok {
+		status.UptimeSeconds = proto.Int64(int64(uptime.Seconds()))
+	}
+
+	if ip4ConfigPath, _ := deviceProps["Ip4Config"].Value().(dbus.ObjectPath); ip4ConfigPath != "" && ip4ConfigPath != "/" {
+		ip4Props, err := getAllProperties(ctx, conn.Object(serviceName, ip4ConfigPath), "org.freedesktop.NetworkManager.IP4Config")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IPv4 config: %v", err)
+		}
+
+		status.Ipv4Addresses = addressDataToCIDRs(ip4Props["AddressData"])
+		status.Ipv4Gateway, _ = ip4Props["Gateway"].Value().(string)
+
+		nameserverData, _ := ip4Props["NameserverData"].Value().([]map[string]dbus.Variant)
+		for _, ns := range nameserverData {
+			if address, ok := ns["address"].Value().(string); ok {
+				status.DnsServers = append(status.DnsServers, address)
+			}
+		}
+	}
+
+	if ip6ConfigPath, _ := deviceProps["Ip6Config"].Value().(dbus.ObjectPath); ip6ConfigPath != "" && ip6ConfigPath != "/" {
+		ip6Props, err := getAllProperties(ctx, conn.Object(serviceName, ip6ConfigPath), "org.freedesktop.NetworkManager.IP6Config")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IPv6 config: %v", err)
+		}
+
+		status.Ipv6Addresses = addressDataToCIDRs(ip6Props["AddressData"])
+		status.Ipv6Gateway, _ = ip6Props["Gateway"].Value().(string)
+
+		// IPv6 nameservers are only exposed as raw 16-byte addresses
+		nameservers, _ := ip6Props["Nameservers"].Value().([][]byte)
+		for _, ns := range nameservers {
+			if len(ns) == net.IPv6len {
+				status.DnsServers = append(status.DnsServers, net.IP(ns).String())
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// addressDataToCIDRs converts an NM AddressData property (aa{sv} with address/prefix) into CIDR strings
+func addressDataToCIDRs(addressData dbus.Variant) []string {
+	entries, _ := addressData.Value().([]map[string]dbus.Variant)
+
+	cidrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		address, ok := entry["address"].Value().(string)
+		if !ok {
+			continue
+		}
+		prefix, _ := entry["prefix"].Value().(uint32)
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", address, prefix))
+	}
+
+	return cidrs
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"connectrpc.com/connect"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// ValidationError lists the invalid fields of a request, so a UI can show each problem next to its input. It wraps
+// the ErrInvalid* error for the kind of input.
+type ValidationError struct {
+	Err        error
+	Violations []*dev.WiFiFieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	descriptions := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		descriptions = append(descriptions, violation.Field+": "+violation.Description)
+	}
+
+	return fmt.Sprintf("%v: %s", e.Err, strings.Join(descriptions, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidArgumentError wraps err in an InvalidArgument Connect error, with a WiFiBadRequest detail listing the
+// field violations when err has them
+func InvalidArgumentError(err error) *connect.Error {
+	connectErr := connect.NewError(connect.CodeInvalidArgument, err)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		return connectErr
+	}
+	detail, detailErr := connect.NewErrorDetail(&dev.WiFiBadRequest{
+		FieldViolations: validationErr.Violations,
+	})
+	if detailErr == nil {
+		connectErr.AddDetail(detail)
+	}
+
+	return connectErr
+}
+
+// violations collects what's wrong with a request, field by field
+type violations []*dev.WiFiFieldViolation
+
+func (v *violations) add(field string, format string, args ...interface{}) {
+	*v = append(*v, &dev.WiFiFieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// err is nil without violations, and otherwise a *ValidationError wrapping kind
+func (v violations) err(kind error) error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	return &ValidationError{
+		Err:        kind,
+		Violations: v,
+	}
+}
+
+// fieldPath is the path of field inside parent, which is empty at the top level of a request
+func fieldPath(parent string, field string) string {
+	if parent == "" {
+		return field
+	}
+
+	return parent + "." + field
+}
+
+// validateSSID checks an SSID is 1 to 32 bytes, the limit of 802.11
+func validateSSID(v *violations, field string, ssid string) {
+	if ssid == "" {
+		v.add(field, "an SSID is required")
+	} else if len(ssid) > 32 {
+		v.add(field, "an SSID is at most 32 bytes, this one is %d", len(ssid))
+	}
+}
+
+// validatePassword checks password against what keyManagement accepts. With automatic key management the network
+// may turn out to be WPA or WEP, so either kind of secret passes.
+func validatePassword(v *violations, field string, keyManagement dev.WiFiKeyManagement, password string) {
+	switch keyManagement {
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WPA_PSK:
+		if problem := pskProblem(password); problem != "" {
+			v.add(field, "%s", problem)
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_SAE:
+		if password == "" {
+			v.add(field, "a password is required")
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_WEP:
+		if problem := wepKeyProblem(password); problem != "" {
+			v.add(field, "%s", problem)
+		}
+	case dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_AUTO:
+		if problem := pskProblem(password); problem != "" && wepKeyProblem(password) != "" {
+			v.add(field, "%s", problem)
+		}
+	}
+}
+
+// pskProblem describes why psk isn't a WPA pre-shared key: 8 to 63 printable ASCII characters, or the 256-bit key
+// itself as 64 hex digits. Empty when it is one.
+func pskProblem(psk string) string {
+	if len(psk) == 64 {
+		if _, err := hex.DecodeString(psk); err != nil {
+			return "a 64 character password must be a key of 64 hex digits"
+		}
+		return ""
+	}
+	if len(psk) < 8 || len(psk) > 63 {
+		return fmt.Sprintf("a WPA password is 8 to 63 characters, this one is %d", len(psk))
+	}
+	if !isPrintableASCII(psk) {
+		return "a WPA password may only contain printable ASCII characters"
+	}
+
+	return ""
+}
+
+// wepKeyProblem describes why key isn't a WEP key of the type wepKeyType sends it as: 5 or 13 characters or 10 or
+// 26 hex digits for the key itself, or a passphrase of up to 64 characters that gets hashed into one. Empty when it
+// is one.
+func wepKeyProblem(key string) string {
+	if key == "" || len(key) > 64 {
+		return "a WEP key is 5 or 13 characters, 10 or 26 hex digits, or a passphrase of up to 64 characters"
+	}
+	if !isPrintableASCII(key) {
+		return "a WEP key may only contain printable ASCII characters"
+	}
+	if wepKeyType(key) == NM_WEP_KEY_TYPE_KEY && (len(key) == 10 || len(key) == 26) {
+		if _, err := hex.DecodeString(key); err != nil {
+			return fmt.Sprintf("a %d character WEP key must be hex digits", len(key))
+		}
+	}
+
+	return ""
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPSKProblem(t *testing.T) {
+	tests := []struct {
+		name  string
+		psk   string
+		valid bool
+	}{
+		{"empty", "", false},
+		{"7 characters", "1234567", false},
+		{"8 characters", "12345678", true},
+		{"63 characters", strings.Repeat("a", 63), true},
+		{"64 hex digits", strings.Repeat("0f", 32), true},
+		{"64 uppercase hex digits", strings.Repeat("0F", 32), true},
+		{"64 characters, not hex", strings.Repeat("g", 64), false},
+		{"65 characters", strings.Repeat("a", 65), false},
+		{"spaces and punctuation", "correct horse battery staple!", true},
+		{"control character", "password\n", false},
+		{"non-ASCII", "pässwörd1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problem := pskProblem(tt.psk); (problem == "") != tt.valid {
+				t.Errorf("pskProblem(%q) = %q, want valid %v", tt.psk, problem, tt.valid)
+			}
+		})
+	}
+}
+
+func TestWEPKeyProblem(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"empty", "", false},
+		{"40-bit ASCII key", "abcde", true},
+		{"104-bit ASCII key", "abcdefghijklm", true},
+		{"40-bit hex key", "0123456789", true},
+		{"104-bit hex key", strings.Repeat("ab", 13), true},
+		{"104-bit hex key, uppercase", strings.Repeat("AB", 13), true},
+		{"passphrase", "a passphrase", true},
+		{"9 character passphrase", "012345678", true},
+		{"64 character passphrase", strings.Repeat("a", 64), true},
+		{"10 characters, not hex", "abcdefghij", false},
+		{"10 characters, hex with a space", "01234 6789", false},
+		{"26 characters, not hex", strings.Repeat("a", 25) + "g", false},
+		{"65 characters", strings.Repeat("a", 65), false},
+		{"control character", "abc\tde", false},
+		{"non-ASCII", "clé12", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problem := wepKeyProblem(tt.key); (problem == "") != tt.valid {
+				t.Errorf("wepKeyProblem(%q) = %q, want valid %v", tt.key, problem, tt.valid)
+			}
+		})
+	}
+}
+
+// violationFields returns the fields of the violations in err, which has to be a *ValidationError wrapping kind
+// unless it's nil
+func violationFields(t *testing.T, err error, kind error) []string {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("error %v is not a *ValidationError", err)
+	}
+	if !errors.Is(err, kind) {
+		t.Errorf("error %v doesn't wrap %v", err, kind)
+	}
+
+	fields := make([]string, 0, len(validationErr.Violations))
+	for _, violation := range validationErr.Violations {
+		fields = append(fields, violation.Field)
+	}
+	slices.Sort(fields)
+
+	return fields
+}
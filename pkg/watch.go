@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+// accessPointWatchedProperties are the AccessPoint properties whose changes are worth an UPDATED event. LastSeen
+// changes on every scan, so it's deliberately left out.
+var accessPointWatchedProperties = []string{"Strength", "Ssid", "Frequency", "Flags", "WpaFlags", "RsnFlags"}
+
+// WatchScan streams access point changes on the matching Wi-Fi devices to send until ctx is done. It sends an
+// initial snapshot, then events from NetworkManager's AccessPointAdded/AccessPointRemoved signals and AccessPoint
+// PropertiesChanged, while requesting a background scan every scanInterval.
+func WatchScan(ctx context.Context, conn *dbus.Conn, networkInterfaceName string, scanInterval time.Duration, send func(*dev.WiFiWatchScanResponse) error) error {
+	devices, err := findWifiDevices(ctx, conn, networkInterfaceName)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return ErrNoWifiDevice
+	}
+
+	matchRules := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Device.Wireless"),
+			dbus.WithMatchMember("AccessPointAdded"),
+		},
+		{
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Device.Wireless"),
+			dbus.WithMatchMember("AccessPointRemoved"),
+		},
+		{
+			dbus.WithMatchPathNamespace("/org/freedesktop/NetworkManager/AccessPoint"),
+			dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+			dbus.WithMatchMember("PropertiesChanged"),
+		},
+	}
+	for _, matchRule := range matchRules {
+		if err := conn.AddMatchSignalContext(ctx, matchRule...); err != nil {
+			return fmt.Errorf("failed to add signal match: %v", err)
+		}
+		defer conn.RemoveMatchSignal(matchRule...)
+	}
+
+	// Subscribe before taking the snapshot so nothing falls in between; duplicates are filtered below
+	sigChan := make(chan *dbus.Signal, 64)
+	conn.Signal(sigChan)
+	defer conn.RemoveSignal(sigChan)
+
+	watchedDevices := map[dbus.ObjectPath]wifiDevice{}
+	accessPoints := map[dbus.ObjectPath]*dev.WiFiAccessPoint{}
+	accessPointDevices := map[dbus.ObjectPath]wifiDevice{}
+	snapshot := []*dev.WiFiAccessPoint{}
+
+	for _, d := range devices {
+		watchedDevices[d.path] = d
+
+		aps, err := deviceAccessPointPaths(conn, d)
+		if err != nil {
+			return fmt.Errorf("failed to get access points: %v", err)
+		}
+
+		for _, ap := range aps {
+			accessPoint, err := readAccessPoint(conn, d, ap)
+			if err != nil {
+				continue
+			}
+			accessPoints[ap] = accessPoint
+			accessPointDevices[ap] = d
+			snapshot = append(snapshot, accessPoint)
+		}
+	}
+
+	if err := send(&dev.WiFiWatchScanResponse{
+		EventType:    dev.WiFiScanEventType_WIFI_SCAN_EVENT_SNAPSHOT,
+		AccessPoints: snapshot,
+	}); err != nil {
+		return err
+	}
+
+	requestBackgroundScan(conn, devices)
+	scanTicker := time.NewTicker(scanInterval)
+	defer scanTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-scanTicker.C:
+			requestBackgroundScan(conn, devices)
+		case sig, ok := <-sigChan:
+			if !ok {
+				return fmt.Errorf("D-Bus connection closed")
+			}
+
+			var event *dev.WiFiWatchScanResponse
+			switch sig.Name {
+			case "org.freedesktop.NetworkManager.Device.Wireless.AccessPointAdded":
+				d, watched := watchedDevices[sig.Path]
+				if !watched || len(sig.Body) < 1 {
+					continue
+				}
+				apPath, _ := sig.Body[0].(dbus.ObjectPath)
+				if _, known := accessPoints[apPath]; known {
+					continue
+				}
+
+				accessPoint, err := readAccessPoint(conn, d, apPath)
+				if err != nil {
+					continue
+				}
+				accessPoints[apPath] = accessPoint
+				accessPointDevices[apPath] = d
+				event = &dev.WiFiWatchScanResponse{
+					EventType:    dev.WiFiScanEventType_WIFI_SCAN_EVENT_ADDED,
+					AccessPoints: []*dev.WiFiAccessPoint{accessPoint},
+				}
+			case "org.freedesktop.NetworkManager.Device.Wireless.AccessPointRemoved":
+				if _, watched := watchedDevices[sig.Path]; !watched || len(sig.Body) < 1 {
+					continue
+				}
+				apPath, _ := sig.Body[0].(dbus.ObjectPath)
+				accessPoint, known := accessPoints[apPath]
+				if !known {
+					continue
+				}
+
+				delete(accessPoints, apPath)
+				delete(accessPointDevices, apPath)
+				event = &dev.WiFiWatchScanResponse{
+					EventType:    dev.WiFiScanEventType_WIFI_SCAN_EVENT_REMOVED,
+					AccessPoints: []*dev.WiFiAccessPoint{accessPoint},
+				}
+			case "org.freedesktop.DBus.Properties.PropertiesChanged":
+				if _, known := accessPoints[sig.Path]; !known || len(sig.Body) < 2 {
+					continue
+				}
+				if iface, _ := sig.Body[0].(string); iface != "org.freedesktop.NetworkManager.AccessPoint" {
+					continue
+				}
+				changed, _ := sig.Body[1].(map[string]dbus.Variant)
+				if !hasAnyKey(changed, accessPointWatchedProperties) {
+					continue
+				}
+
+				accessPoint, err := readAccessPoint(conn, accessPointDevices[sig.Path], sig.Path)
+				if err != nil {
+					continue
+				}
+				accessPoints[sig.Path] = accessPoint
+				event = &dev.WiFiWatchScanResponse{
+					EventType:    dev.WiFiScanEventType_WIFI_SCAN_EVENT_UPDATED,
+					AccessPoints: []*dev.WiFiAccessPoint{accessPoint},
+				}
+			default:
+				continue
+			}
+
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// requestBackgroundScan kicks off a scan without waiting for it; results arrive as AccessPointAdded/Removed signals
+func requestBackgroundScan(conn *dbus.Conn, devices []wifiDevice) {
+	for _, d := range devices {
+		err := d.object(conn).Call("org.freedesktop.NetworkManager.Device.Wireless.RequestScan", 0, map[string]dbus.Variant{}).Err
+		if err != nil && !isScanNotAllowed(err) {
+			log.Printf("Failed to request background scan on %s: %v", d.interfaceName, err)
+		}
+	}
+}
+
+func hasAnyKey(m map[string]dbus.Variant, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -6,6 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -13,44 +16,114 @@ import (
 	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
 )
 
+// NM_802_11_AP_FLAGS (for Flags)
+//
+//goland:noinspection GoSnakeCaseUsage
+const (
+	NM_802_11_AP_FLAGS_NONE    = 0x00000000
+	NM_802_11_AP_FLAGS_PRIVACY = 0x00000001 // Encryption required (WEP when there are no WPA/RSN flags)
+	NM_802_11_AP_FLAGS_WPS     = 0x00000002 // WPS supported
+	NM_802_11_AP_FLAGS_WPS_PBC = 0x00000004 // WPS push-button
+	NM_802_11_AP_FLAGS_WPS_PIN = 0x00000008 // WPS PIN
+)
+
 // NM_802_11_AP_SEC flags (for WpaFlags and RsnFlags)
 //
 //goland:noinspection GoSnakeCaseUsage
 const (
-	NM_802_11_AP_SEC_NONE            = 0x0000
-	NM_802_11_AP_SEC_PAIR_WEP40      = 0x0001 // WEP (40-bit)
-	NM_802_11_AP_SEC_PAIR_WEP104     = 0x0002 // WEP (104-bit)
-	NM_802_11_AP_SEC_PAIR_TKIP       = 0x0004 // TKIP encryption
-	NM_802_11_AP_SEC_PAIR_CCMP       = 0x0008 // CCMP encryption
-	NM_802_11_AP_SEC_GROUP_WEP40     = 0x0010 // WEP (40-bit)
-	NM_802_11_AP_SEC_GROUP_WEP104    = 0x0020 // WEP (104-bit)
-	NM_802_11_AP_SEC_GROUP_TKIP      = 0x0040 // Group TKIP
-	NM_802_11_AP_SEC_GROUP_CCMP      = 0x0080 // Group CCMP
-	NM_802_11_AP_SEC_KEY_MGMT_PSK    = 0x0100 // Pre-shared key
-	NM_802_11_AP_SEC_KEY_MGMT_802_1X = 0x0200 // 802.1X
+	NM_802_11_AP_SEC_NONE                     = 0x0000
+	NM_802_11_AP_SEC_PAIR_WEP40               = 0x0001 // WEP (40-bit)
+	NM_802_11_AP_SEC_PAIR_WEP104              = 0x0002 // WEP (104-bit)
+	NM_802_11_AP_SEC_PAIR_TKIP                = 0x0004 // TKIP encryption
+	NM_802_11_AP_SEC_PAIR_CCMP                = 0x0008 // CCMP encryption
+	NM_802_11_AP_SEC_GROUP_WEP40              = 0x0010 // WEP (40-bit)
+	NM_802_11_AP_SEC_GROUP_WEP104             = 0x0020 // WEP (104-bit)
+	NM_802_11_AP_SEC_GROUP_TKIP               = 0x0040 // Group TKIP
+	NM_802_11_AP_SEC_GROUP_CCMP               = 0x0080 // Group CCMP
+	NM_802_11_AP_SEC_KEY_MGMT_PSK             = 0x0100 // Pre-shared key
+	NM_802_11_AP_SEC_KEY_MGMT_802_1X          = 0x0200 // 802.1X
+	NM_802_11_AP_SEC_KEY_MGMT_SAE             = 0x0400 // Simultaneous Authentication of Equals (WPA3 Personal)
+	NM_802_11_AP_SEC_KEY_MGMT_OWE             = 0x0800 // Opportunistic Wireless Encryption (Enhanced Open)
+	NM_802_11_AP_SEC_KEY_MGMT_OWE_TM          = 0x1000 // OWE transition mode (open BSS advertising an OWE BSS)
+	NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192 = 0x2000 // WPA3 Enterprise 192-bit
+)
+
+var secFlagNames = []struct {
+	flag uint32
+	name string
+}{
+	{NM_802_11_AP_SEC_KEY_MGMT_PSK, "psk"},
+	{NM_802_11_AP_SEC_KEY_MGMT_802_1X, "802.1x"},
+	{NM_802_11_AP_SEC_KEY_MGMT_SAE, "sae"},
+	{NM_802_11_AP_SEC_KEY_MGMT_OWE, "owe"},
+	{NM_802_11_AP_SEC_KEY_MGMT_OWE_TM, "owe-tm"},
+	{NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192, "eap-suite-b-192"},
+	{NM_802_11_AP_SEC_PAIR_WEP40, "wep40"},
+	{NM_802_11_AP_SEC_PAIR_WEP104, "wep104"},
+	{NM_802_11_AP_SEC_PAIR_TKIP, "tkip"},
+	{NM_802_11_AP_SEC_PAIR_CCMP, "ccmp"},
+	{NM_802_11_AP_SEC_GROUP_WEP40, "wep40"},
+	{NM_802_11_AP_SEC_GROUP_WEP104, "wep104"},
+	{NM_802_11_AP_SEC_GROUP_TKIP, "tkip"},
+	{NM_802_11_AP_SEC_GROUP_CCMP, "ccmp"},
+}
+
+const (
+	secKeyMgmtMask = NM_802_11_AP_SEC_KEY_MGMT_PSK | NM_802_11_AP_SEC_KEY_MGMT_802_1X | NM_802_11_AP_SEC_KEY_MGMT_SAE |
+		NM_802_11_AP_SEC_KEY_MGMT_OWE | NM_802_11_AP_SEC_KEY_MGMT_OWE_TM | NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192
+	secPairwiseMask = NM_802_11_AP_SEC_PAIR_WEP40 | NM_802_11_AP_SEC_PAIR_WEP104 | NM_802_11_AP_SEC_PAIR_TKIP | NM_802_11_AP_SEC_PAIR_CCMP
+	secGroupMask    = NM_802_11_AP_SEC_GROUP_WEP40 | NM_802_11_AP_SEC_GROUP_WEP104 | NM_802_11_AP_SEC_GROUP_TKIP | NM_802_11_AP_SEC_GROUP_CCMP
+	secWEPMask      = NM_802_11_AP_SEC_PAIR_WEP40 | NM_802_11_AP_SEC_PAIR_WEP104 | NM_802_11_AP_SEC_GROUP_WEP40 | NM_802_11_AP_SEC_GROUP_WEP104
 )
 
-func determineSecurity(wpaFlags, rsnFlags uint32) dev.WiFiSecurityType {
+// secFlagsToNames lists the names of the flags in secFlags (WpaFlags|RsnFlags) that fall within mask, without duplicates
+func secFlagsToNames(secFlags uint32, mask uint32) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, f := range secFlagNames {
+		if f.flag&mask == 0 || secFlags&f.flag == 0 || seen[f.name] {
+			continue
+		}
+		seen[f.name] = true
+		names = append(names, f.name)
+	}
+
+	return names
+}
+
+func determineSecurity(apFlags, wpaFlags, rsnFlags uint32) dev.WiFiSecurityType {
 	if wpaFlags == NM_802_11_AP_SEC_NONE && rsnFlags == NM_802_11_AP_SEC_NONE {
+		// Legacy WEP networks only set the privacy flag
+		if apFlags&NM_802_11_AP_FLAGS_PRIVACY != 0 {
+			return dev.WiFiSecurityType_WIFI_SECURITY_WEP
+		}
 		return dev.WiFiSecurityType_WIFI_SECURITY_OPEN
 	}
 
 	// Check for WEP
-	if wpaFlags&(NM_802_11_AP_SEC_PAIR_WEP40|NM_802_11_AP_SEC_PAIR_WEP104|NM_802_11_AP_SEC_GROUP_WEP40|NM_802_11_AP_SEC_GROUP_WEP104) != 0 {
+	if (wpaFlags|rsnFlags)&secWEPMask != 0 && (wpaFlags|rsnFlags)&secKeyMgmtMask == 0 {
 		return dev.WiFiSecurityType_WIFI_SECURITY_WEP
 	}
 
-	// Check for WPA3 Enterprise
-	if rsnFlags&(NM_802_11_AP_SEC_KEY_MGMT_802_1X) != 0 && rsnFlags&(NM_802_11_AP_SEC_PAIR_CCMP|NM_802_11_AP_SEC_GROUP_CCMP) != 0 {
-		return dev.WiFiSecurityType_WIFI_SECURITY_WPA3_EAP
+	// Check for WPA3 Enterprise 192-bit (Suite-B)
+	if rsnFlags&NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192 != 0 {
+		return dev.WiFiSecurityType_WIFI_SECURITY_WPA3_EAP_192
 	}
 
-	// Check for WPA3 Personal
-	if rsnFlags&(NM_802_11_AP_SEC_KEY_MGMT_PSK) != 0 && rsnFlags&(NM_802_11_AP_SEC_PAIR_CCMP|NM_802_11_AP_SEC_GROUP_CCMP) != 0 {
+	// Check for WPA3 Personal, and WPA2/WPA3 transition mode which also accepts PSK
+	if rsnFlags&NM_802_11_AP_SEC_KEY_MGMT_SAE != 0 {
+		if rsnFlags&NM_802_11_AP_SEC_KEY_MGMT_PSK != 0 {
+			return dev.WiFiSecurityType_WIFI_SECURITY_WPA3_TRANSITION
+		}
 		return dev.WiFiSecurityType_WIFI_SECURITY_WPA3_PSK
 	}
 
-	// Check for WPA2 Enterprise
+	// Check for Enhanced Open, including the open side of an OWE transition pair
+	if rsnFlags&(NM_802_11_AP_SEC_KEY_MGMT_OWE|NM_802_11_AP_SEC_KEY_MGMT_OWE_TM) != 0 {
+		return dev.WiFiSecurityType_WIFI_SECURITY_OWE
+	}
+
+	// Check for WPA2 Enterprise. WPA3 Enterprise (non-192) only differs by requiring PMF, which NM doesn't expose
 	if rsnFlags&(NM_802_11_AP_SEC_KEY_MGMT_802_1X) != 0 {
 		return dev.WiFiSecurityType_WIFI_SECURITY_WPA2_EAP
 	}
@@ -73,240 +146,403 @@ func determineSecurity(wpaFlags, rsnFlags uint32) dev.WiFiSecurityType {
 	return dev.WiFiSecurityType_WIFI_SECURITY_UNKNOWN
 }
 
+// frequencyToBandChannel maps a center frequency (MHz) to its band and channel number, per IEEE 802.11 channel
+// numbering (https://en.wikipedia.org/wiki/List_of_WLAN_channels). Channel numbers are only unique within a band,
+// e.g. 2412 MHz and 5955 MHz are both channel 1. Unknown frequencies map to (WIFI_BAND_UNKNOWN, 0).
+func frequencyToBandChannel(freq int32) (dev.WiFiBand, int32) {
+	switch {
+	// 2.4 GHz
+	case freq == 2484:
+		return dev.WiFiBand_WIFI_BAND_2_4_GHZ, 14
+	case freq >= 2412 && freq <= 2472 && (freq-2407)%5 == 0:
+		return dev.WiFiBand_WIFI_BAND_2_4_GHZ, (freq - 2407) / 5
+
+	// 4.9 GHz (Japan, public safety) uses 5 GHz radios and is numbered from 4000 MHz
+	case freq >= 4910 && freq <= 4980 && freq%5 == 0:
+		return dev.WiFiBand_WIFI_BAND_5_GHZ, (freq - 4000) / 5
+
+	// 5 GHz
+	case freq >= 5160 && freq <= 5885 && freq%5 == 0:
+		return dev.WiFiBand_WIFI_BAND_5_GHZ, (freq - 5000) / 5
+
+	// 6 GHz; channel 2 is the odd one out below the regular 20 MHz grid starting at 5955
+	case freq == 5935:
+		return dev.WiFiBand_WIFI_BAND_6_GHZ, 2
+	case freq >= 5955 && freq <= 7115 && (freq-5950)%5 == 0:
+		return dev.WiFiBand_WIFI_BAND_6_GHZ, (freq - 5950) / 5
+
+	// 60 GHz (802.11ad/ay), 2160 MHz channels
+	case freq >= 58320 && freq <= 69120 && (freq-56160)%2160 == 0:
+		return dev.WiFiBand_WIFI_BAND_60_GHZ, (freq - 56160) / 2160
+	}
+
+	return dev.WiFiBand_WIFI_BAND_UNKNOWN, 0
+}
+
 func frequencyToChannel(freq int32) int32 {
-	type freqRange struct {
-		low  int32
-		high int32
-	}
-
-	// https://en.wikipedia.org/wiki/List_of_WLAN_channels
-	var freqRangeToChannel = map[freqRange]int32{
-		// 2.4 GHz
-		{2401, 2423}: 1,
-		{2406, 2428}: 2,
-		{2411, 2433}: 3,
-		{2416, 2438}: 4,
-		{2421, 2443}: 5,
-		{2426, 2448}: 6,
-		{2431, 2453}: 7,
-		{2436, 2458}: 8,
-		{2441, 2463}: 9,
-		{2446, 2468}: 10,
-		{2451, 2473}: 11,
-		{2456, 2478}: 12,
-		{2461, 2483}: 13,
-		{2473, 2495}: 14,
-
-		// 5 GHz
-		{5150, 5170}: 32,
-		{5170, 5190}: 36,
-		{5190, 5210}: 40,
-		{5210, 5230}: 44,
-		{5230, 5250}: 48,
-		{5250, 5270}: 52,
-		{5270, 5290}: 56,
-		{5290, 5310}: 60,
-		{5310, 5330}: 64,
-		{5330, 5350}: 68,
-		{5350, 5370}: 72,
-		{5370, 5390}: 76,
-		{5390, 5410}: 80,
-		{5410, 5430}: 84,
-		{5430, 5450}: 88,
-		{5450, 5470}: 92,
-		{5470, 5490}: 96,
-		{5490, 5510}: 100,
-		{5510, 5530}: 104,
-		{5530, 5550}: 108,
-		{5550, 5570}: 112,
-		{5570, 5590}: 116,
-		{5590, 5610}: 120,
-		{5610, 5630}: 124,
-		{5630, 5650}: 128,
-		{5650, 5670}: 132,
-		{5670, 5690}: 136,
-		{5690, 5710}: 140,
-		{5710, 5730}: 144,
-		{5735, 5755}: 149,
-		{5755, 5775}: 153,
-		{5775, 5795}: 157,
-		{5795, 5815}: 161,
-		{5815, 5835}: 165,
-		{5835, 5855}: 169,
-		{5855, 5875}: 173,
-		{5875, 5895}: 177,
-
-		// 6 GHz
-		{5925, 5945}: 2,
-		{5945, 5965}: 1,
-		{5965, 5985}: 5,
-		{5985, 6005}: 9,
-		{6005, 6025}: 13,
-		{6025, 6045}: 17,
-		{6045, 6065}: 21,
-		{6065, 6085}: 25,
-		{6085, 6105}: 29,
-		{6105, 6125}: 33,
-		{6125, 6145}: 37,
-		{6145, 6165}: 41,
-		{6165, 6185}: 45,
-		{6185, 6205}: 49,
-		{6205, 6225}: 53,
-		{6225, 6245}: 57,
-		{6245, 6265}: 61,
-		{6265, 6285}: 65,
-		{6285, 6305}: 69,
-		{6305, 6325}: 73,
-		{6325, 6345}: 77,
-		{6345, 6365}: 81,
-		{6365, 6385}: 85,
-		{6385, 6405}: 89,
-		{6405, 6425}: 93,
-		{6425, 6445}: 97,
-		{6445, 6465}: 101,
-		{6465, 6485}: 105,
-		{6485, 6505}: 109,
-		{6505, 6525}: 113,
-		{6525, 6545}: 117,
-		{6545, 6565}: 121,
-		{6565, 6585}: 125,
-		{6585, 6605}: 129,
-		{6605, 6625}: 133,
-		{6625, 6645}: 137,
-		{6645, 6665}: 141,
-		{6665, 6685}: 145,
-		{6685, 6705}: 149,
-		{6705, 6725}: 153,
-		{6725, 6745}: 157,
-		{6745, 6765}: 161,
-		{6765, 6785}: 165,
-		{6785, 6805}: 169,
-		{6805, 6825}: 173,
-		{6825, 6845}: 177,
-		{6845, 6865}: 181,
-		{6865, 6885}: 185,
-		{6885, 6905}: 189,
-		{6905, 6925}: 193,
-		{6925, 6945}: 197,
-		{6945, 6965}: 201,
-		{6965, 6985}: 205,
-		{6985, 7005}: 209,
-		{7005, 7025}: 213,
-		{7025, 7045}: 217,
-		{7045, 7065}: 221,
-		{7065, 7085}: 225,
-		{7085, 7105}: 229,
-		{7105, 7125}: 233,
-	}
-
-	for r, c := range freqRangeToChannel {
-		if freq >= r.low && freq <= r.high {
-			return c
-		}
-	}
-
-	return 0
-}
-
-func rssiToRating(rssi int32) dev.WiFiSignalRating {
-	if rssi >= -50 {
+	_, channel := frequencyToBandChannel(freq)
+	return channel
+}
+
+func frequencyToBand(freq int32) dev.WiFiBand {
+	band, _ := frequencyToBandChannel(freq)
+	return band
+}
+
+// rssiToRating rates a signal level in dBm (not NM's Strength percentage); 0 means the level is unknown
+func rssiToRating(rssiDbm int32) dev.WiFiSignalRating {
+	if rssiDbm == 0 {
+		return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_UNKNOWN
+	} else if rssiDbm >= -55 {
 		return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_EXCELLENT
-	} else if rssi >= -60 {
+	} else if rssiDbm >= -67 {
 		return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_GOOD
-	} else if rssi >= -70 {
+	} else if rssiDbm >= -75 {
 		return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_FAIR
-	} else if rssi >= -80 {
+	} else if rssiDbm >= -85 {
 		return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_POOR
 	}
 	return dev.WiFiSignalRating_WIFI_SIGNAL_STRENGTH_NONE
 }
 
-func WifiScan(ctx context.Context, conn *dbus.Conn, networkInterfaceName string) ([]*dev.WiFiAccessPoint, error) {
-	accessPoints := []*dev.WiFiAccessPoint{}
+// WifiScan triggers a scan on every matching Wi-Fi device in parallel and waits (until ctx is done) for
+// NetworkManager to report them complete. If NM refuses to scan (rate limited, or the radio is in AP mode) or ctx
+// expires first, the cached access point list is used and the result is marked stale. When several radios see the
+// same BSSID, the strongest reading wins and every radio's reading is listed in interface_signals.
+func WifiScan(ctx context.Context, conn *dbus.Conn, networkInterfaceName string) (*dev.WiFiScanResult, error) {
+	devices, err := findWifiDevices(ctx, conn, networkInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoWifiDevice
+	}
 
-	// The object path for NetworkManager
-	nmPath := dbus.ObjectPath("/org/freedesktop/NetworkManager")
-	nm := conn.Object("org.freedesktop.NetworkManager", nmPath)
+	return mergeDeviceScans(scanDevices(ctx, conn, devices)), nil
+}
 
-	// Get all devices
-	devices, err := nm.GetProperty("org.freedesktop.NetworkManager.AllDevices")
+// deviceScan holds the access points a single device reported
+type deviceScan struct {
+	interfaceName string
+	accessPoints  []*dev.WiFiAccessPoint
+	// fresh is false when the access points are from before the last scan request (see requestScanAndWait)
+	fresh bool
+	// fromCache marks access points served from the ScanCache because the device is in AP mode
+	fromCache bool
+	err       error
+}
+
+// scanDevices scans on every one of devices in parallel
+func scanDevices(ctx context.Context, conn *dbus.Conn, devices []wifiDevice) []deviceScan {
+	// Read saved profiles up front; ctx may well be expired once the scan wait is over
+	savedProfiles, err := savedWifiProfiles(ctx, conn)
 	if err != nil {
-		log.Fatalf("Failed to get devices: %v", err)
+		log.Printf("Failed to read saved connections, scan results won't show saved networks: %v", err)
 	}
 
-	for _, d := range devices.Value().([]dbus.ObjectPath) {
-		device := conn.Object("org.freedesktop.NetworkManager", d)
-		deviceType, err := device.GetProperty("org.freedesktop.NetworkManager.Device.DeviceType")
-		if err != nil {
-			continue // Skip on error
-		}
+	deviceScans := make([]deviceScan, len(devices))
+
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accessPoints, fresh, err := scanDevice(ctx, conn, d, savedProfiles)
+			deviceScans[i] = deviceScan{
+				interfaceName: d.interfaceName,
+				accessPoints:  accessPoints,
+				fresh:         fresh,
+				err:           err,
+			}
+		}()
+	}
+	wg.Wait()
 
-		deviceInterfaceName, err := device.GetProperty("org.freedesktop.NetworkManager.Device.Interface")
-		if err != nil {
-			continue // Skip on error
-		}
+	return deviceScans
+}
 
-		if networkInterfaceName != "" {
-			if deviceInterfaceName.Value().(string) != networkInterfaceName {
-				continue
-			}
+// mergeDeviceScans combines the access points of several devices into a single result, one entry per BSSID
+func mergeDeviceScans(deviceScans []deviceScan) *dev.WiFiScanResult {
+	scanResult := &dev.WiFiScanResult{
+		AccessPoints: []*dev.WiFiAccessPoint{},
+	}
+	byBSSID := map[string]int{} // index into scanResult.AccessPoints
+
+	for _, deviceScan := range deviceScans {
+		if deviceScan.err != nil {
+			log.Printf("Failed to scan on %s: %v", deviceScan.interfaceName, deviceScan.err)
+			continue
+		}
+		if !deviceScan.fresh {
+			scanResult.Stale = true
+		}
+		if deviceScan.fromCache {
+			scanResult.FromCache = true
 		}
 
-		// Check if the device is a WiFi device (type 2)
-		if deviceType.Value().(uint32) == 2 {
-			// initiate a scan
-			// RequestScan expects “(a{sv})”?
-			scan := device.Call("org.freedesktop.NetworkManager.Device.Wireless.RequestScan", 0, map[string]dbus.Variant{})
-			if scan.Err != nil {
-				log.Printf("Failed to initiate scan: %v", scan.Err)
+		for _, accessPoint := range deviceScan.accessPoints {
+			accessPoint.InterfaceSignals = []*dev.WiFiInterfaceSignal{{
+				NetworkInterface: accessPoint.NetworkInterface,
+				RssiDbm:          accessPoint.RssiDbm,
+				SignalPercent:    accessPoint.SignalPercent,
+				IsConnected:      accessPoint.IsConnected,
+			}}
+
+			idx, seen := byBSSID[accessPoint.BSSID]
+			if !seen {
+				byBSSID[accessPoint.BSSID] = len(scanResult.AccessPoints)
+				scanResult.AccessPoints = append(scanResult.AccessPoints, accessPoint)
 				continue
 			}
 
-			wireless := conn.Object("org.freedesktop.NetworkManager", d)
-			call := wireless.Call("org.freedesktop.NetworkManager.Device.Wireless.GetAccessPoints", 0)
-			if call.Err != nil {
-				log.Printf("Failed to get access points: %v", call.Err)
-				continue
+			merged := scanResult.AccessPoints[idx]
+			strongest, other := merged, accessPoint
+			if accessPoint.RssiDbm > merged.RssiDbm {
+				strongest, other = accessPoint, merged
 			}
+			strongest.InterfaceSignals = append(merged.InterfaceSignals, accessPoint.InterfaceSignals...)
+			strongest.IsConnected = strongest.IsConnected || other.IsConnected
+			scanResult.AccessPoints[idx] = strongest
+		}
+	}
 
-			var aps []dbus.ObjectPath
-			if err := call.Store(&aps); err != nil {
-				log.Printf("Failed to store access points: %v", err)
-				continue
-			}
+	return scanResult
+}
 
-			//var networks []WiFiNetwork
-			for _, ap := range aps {
-				accessPoint := conn.Object("org.freedesktop.NetworkManager", ap)
-				ssid, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.Ssid")
-				bsid, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.HwAddress")
-				frequency, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.Frequency")
-				strength, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.Strength")
-				ssidStr := string(ssid.Value().([]byte)) // Convert []byte to string
-
-				wpaFlags, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.WpaFlags")
-				rsnFlags, _ := accessPoint.GetProperty("org.freedesktop.NetworkManager.AccessPoint.RsnFlags")
-
-				protoSecurityType := determineSecurity(wpaFlags.Value().(uint32), rsnFlags.Value().(uint32))
-
-				accessPoints = append(accessPoints, &dev.WiFiAccessPoint{
-					SSID:         ssidStr,
-					BSSID:        bsid.Value().(string),
-					RSSI:         int32(strength.Value().(uint8)),
-					Frequency:    int32(frequency.Value().(uint32)),
-					Channel:      frequencyToChannel(int32(frequency.Value().(uint32))),
-					SignalRating: rssiToRating(int32(strength.Value().(uint8))),
-					SecurityType: protoSecurityType,
-					EapConfig:    nil,
-				})
+// scanDevice scans on a single device and reads its access points; see requestScanAndWait for fresh
+func scanDevice(ctx context.Context, conn *dbus.Conn, d wifiDevice, savedProfiles map[string][]savedProfile) ([]*dev.WiFiAccessPoint, bool, error) {
+	fresh, err := requestScanAndWait(ctx, conn, d, map[string]dbus.Variant{})
+	if err != nil {
+		return nil, false, err
+	}
+
+	aps, err := deviceAccessPointPaths(conn, d)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get access points: %v", err)
+	}
+
+	var activeAP dbus.ObjectPath
+	if activeAPProp, err := d.object(conn).GetProperty("org.freedesktop.NetworkManager.Device.Wireless.ActiveAccessPoint"); err == nil {
+		activeAP, _ = activeAPProp.Value().(dbus.ObjectPath)
+	}
+
+	accessPoints := []*dev.WiFiAccessPoint{}
+	for _, ap := range aps {
+		accessPoint, err := readAccessPoint(conn, d, ap)
+		if err != nil {
+			// APs can disappear between listing and reading them
+			log.Printf("Failed to read access point %s: %v", ap, err)
+			continue
+		}
+		annotateAccessPoint(accessPoint, ap == activeAP, savedProfiles[accessPoint.SSID], d.interfaceName)
+
+		accessPoints = append(accessPoints, accessPoint)
+	}
+
+	return accessPoints, fresh, nil
+}
+
+func deviceAccessPointPaths(conn *dbus.Conn, d wifiDevice) ([]dbus.ObjectPath, error) {
+	call := d.object(conn).Call("org.freedesktop.NetworkManager.Device.Wireless.GetAccessPoints", 0)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	var aps []dbus.ObjectPath
+	if err := call.Store(&aps); err != nil {
+		return nil, err
+	}
+
+	return aps, nil
+}
+
+func readAccessPoint(conn *dbus.Conn, d wifiDevice, ap dbus.ObjectPath) (*dev.WiFiAccessPoint, error) {
+	props, err := getAllProperties(context.Background(), conn.Object(serviceName, ap), "org.freedesktop.NetworkManager.AccessPoint")
+	if err != nil {
+		return nil, err
+	}
+
+	ssid, _ := props["Ssid"].Value().([]byte)
+	bssid, _ := props["HwAddress"].Value().(string)
+	frequency, _ := props["Frequency"].Value().(uint32)
+	strength, _ := props["Strength"].Value().(uint8)
+	apFlags, _ := props["Flags"].Value().(uint32)
+	wpaFlags, _ := props["WpaFlags"].Value().(uint32)
+	rsnFlags, _ := props["RsnFlags"].Value().(uint32)
+	maxBitrate, _ := props["MaxBitrate"].Value().(uint32)
+	mode, _ := props["Mode"].Value().(uint32)
+	// Bandwidth is only exposed since NetworkManager 1.46
+	bandwidth, _ := props["Bandwidth"].Value().(uint32)
+	lastSeen, hasLastSeen := props["LastSeen"].Value().(int32)
+
+	rssiDbm, rssiEstimated := accessPointDbm(conn, d.interfaceName, bssid, strength)
+
+	accessPoint := &dev.WiFiAccessPoint{
+		SSID:               string(ssid),
+		BSSID:              bssid,
+		RSSI:               rssiDbm,
+		Frequency:          int32(frequency),
+		Channel:            frequencyToChannel(int32(frequency)),
+		Band:               frequencyToBand(int32(frequency)),
+		SignalRating:       rssiToRating(rssiDbm),
+		SecurityType:       determineSecurity(apFlags, wpaFlags, rsnFlags),
+		EapConfig:          nil,
+		SignalPercent:      int32(strength),
+		RssiDbm:            rssiDbm,
+		RssiEstimated:      rssiEstimated,
+		WpaFlags:           wpaFlags,
+		RsnFlags:           rsnFlags,
+		KeyManagement:      secFlagsToNames(wpaFlags|rsnFlags, secKeyMgmtMask),
+		PairwiseCiphers:    secFlagsToNames(wpaFlags|rsnFlags, secPairwiseMask),
+		GroupCiphers:       secFlagsToNames(wpaFlags|rsnFlags, secGroupMask),
+		MaxBitrateKbps:     int32(maxBitrate),
+		Mode:               dev.WiFiMode(mode),
+		Flags:              apFlags,
+		Privacy:            apFlags&NM_802_11_AP_FLAGS_PRIVACY != 0,
+		WpsSupported:       apFlags&NM_802_11_AP_FLAGS_WPS != 0,
+		WpsPushButton:      apFlags&NM_802_11_AP_FLAGS_WPS_PBC != 0,
+		WpsPin:             apFlags&NM_802_11_AP_FLAGS_WPS_PIN != 0,
+		BandwidthMhz:       int32(bandwidth),
+		LastSeenSecondsAgo: -1,
+	}
+
+	// LastSeen is in CLOCK_BOOTTIME seconds, or -1 if the AP was never found in a scan
+	if hasLastSeen && lastSeen >= 0 {
+		if uptime, err := secondsSinceBoot(); err == nil && uptime >= int64(lastSeen) {
+			accessPoint.LastSeenSecondsAgo = int32(uptime - int64(lastSeen))
+		}
+	}
+
+	return accessPoint, nil
+}
+
+// scanPollInterval is how often LastScan is checked while waiting for a scan to complete
+const scanPollInterval = 250 * time.Millisecond
+
+// requestScanAndWait asks NM to scan on d and waits for the device's LastScan to advance. fresh is false when NM
+// refused the scan or ctx ended before the scan completed; the device's cached results are still usable then.
+func requestScanAndWait(ctx context.Context, conn *dbus.Conn, d wifiDevice, options map[string]dbus.Variant) (fresh bool, err error) {
+	device := d.object(conn)
+
+	lastScan, err := deviceLastScan(device)
+	if err != nil {
+		return false, err
+	}
+
+	scan := device.CallWithContext(ctx, "org.freedesktop.NetworkManager.Device.Wireless.RequestScan", 0, options)
+	if scan.Err != nil {
+		if isScanNotAllowed(scan.Err) {
+			log.Printf("Scan not allowed on %s, using cached results: %v", d.interfaceName, scan.Err)
+			return false, nil
+		}
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to initiate scan: %v", scan.Err)
+	}
+
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Scan on %s did not complete in time, using cached results", d.interfaceName)
+			return false, nil
+		case <-ticker.C:
+			currentLastScan, err := deviceLastScan(device)
+			if err != nil {
+				return false, err
+			}
+			if currentLastScan > lastScan {
+				return true, nil
 			}
 		}
 	}
+}
+
+// deviceLastScan returns the device's LastScan property: CLOCK_BOOTTIME milliseconds of the last completed scan,
+// or -1 if the device never scanned
+func deviceLastScan(device dbus.BusObject) (int64, error) {
+	lastScan, err := device.GetProperty("org.freedesktop.NetworkManager.Device.Wireless.LastScan")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last scan time: %v", err)
+	}
+
+	return lastScan.Value().(int64), nil
+}
+
+// isScanNotAllowed reports whether NM rejected RequestScan, e.g. "Scanning not allowed while in AP mode" or because
+// a scan was requested too soon after the previous one
+func isScanNotAllowed(err error) bool {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return false
+	}
+
+	return dbusErr.Name == "org.freedesktop.NetworkManager.Device.NotAllowed" ||
+		strings.Contains(strings.ToLower(dbusErr.Error()), "not allowed")
+}
+
+var (
+	ErrInvalidPersistMode    = errors.New("invalid persist mode")
+	ErrInvalidConnectRequest = errors.New("invalid connect request")
+)
+
+// ConnectWiFi connects to request.SSID and waits for the activation to complete. With request.Rollback enabled,
+// a failed switch (or one that leaves the device without internet) restores the previous networking state. With a
+// store (i.e. a registered secret agent) the profile's secrets are kept there instead of in the profile.
+func ConnectWiFi(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiConnectRequest, progress ProgressFunc) error {
+	if err := ValidateConnectRequest(request); err != nil {
+		return err
+	}
+
+	device, err := resolveWifiDevice(ctx, conn, request.NetworkInterface)
+	if err != nil {
+		return err
+	}
+
+	rollback := request.Rollback
+	if request.Persist == dev.WiFiPersistMode_WIFI_PERSIST_MODE_ON_SUCCESS && rollback.GetEnabled() && !rollback.SkipConnectivityCheck {
+		// connectWiFi verifies the connection before saving it, so checking again afterwards would only take longer
+		rollback = &dev.WiFiRollbackOptions{
+			Enabled:               true,
+			TimeoutSeconds:        rollback.TimeoutSeconds,
+			SkipConnectivityCheck: true,
+		}
+	}
+
+	return withRollback(ctx, conn, []wifiDevice{device}, rollback, progress, func(ctx context.Context) error {
+		return connectWiFi(ctx, conn, store, request, device, progress)
+	})
+}
+
+// CheckConnectDevice makes sure the device request would connect on exists, so a request that can't work is turned
+// down before anything changes
+func CheckConnectDevice(ctx context.Context, conn *dbus.Conn, request *dev.WiFiConnectRequest) error {
+	_, err := resolveWifiDevice(ctx, conn, request.NetworkInterface)
+	return err
+}
+
+// ValidateConnectRequest checks everything about request that can be checked without NetworkManager, reporting
+// every invalid field at once
+func ValidateConnectRequest(request *dev.WiFiConnectRequest) error {
+	var v violations
+	validateConnectOptions(&v, request)
+	validateIPConfig(&v, "ipv4", "ipv4", request.Ipv4)
+	validateIPConfig(&v, "ipv6", "ipv6", request.Ipv6)
+	validateRollbackOptions(&v, "rollback", request.Rollback)
+	if _, ok := dev.WiFiPersistMode_name[int32(request.Persist)]; !ok {
+		v.add("persist", "unknown persist mode %d", request.Persist)
+	}
+	if eapSecret, ok := request.GetSecret().(*dev.WiFiConnectRequest_EapConfig); ok {
+		validateEAPConfig(&v, "eap_config", eapSecret.EapConfig, time.Now())
+	}
 
-	return accessPoints, nil
+	return v.err(ErrInvalidConnectRequest)
 }
 
-func ConnectWiFi(ctx context.Context, conn *dbus.Conn, request *dev.WiFiConnectRequest) error {
+func connectWiFi(ctx context.Context, conn *dbus.Conn, store *SecretStore, request *dev.WiFiConnectRequest, device wifiDevice, progress ProgressFunc) error {
 	nmPath := dbus.ObjectPath("/org/freedesktop/NetworkManager")
 	nm := conn.Object("org.freedesktop.NetworkManager", nmPath)
 
@@ -320,119 +556,265 @@ func ConnectWiFi(ctx context.Context, conn *dbus.Conn, request *dev.WiFiConnectR
 			"type": dbus.MakeVariant("802-11-wireless"),
 			"id":   dbus.MakeVariant(request.SSID),
 		},
+		"ipv4": ipSettings("ipv4", request.Ipv4),
+		"ipv6": ipSettings("ipv6", request.Ipv6),
+	}
+	if request.NetworkInterface != "" {
+		connection["connection"]["interface-name"] = dbus.MakeVariant(device.interfaceName)
 	}
 
-	// Determine the security type based on provided credentials
-	switch request.GetSecret().(type) {
-	case *dev.WiFiConnectRequest_IsOpen:
-		if !request.GetSecret().(*dev.WiFiConnectRequest_IsOpen).IsOpen {
-			return errors.New("secret oneOf 'IsOpen' must be true, as any other condition must be specified instead")
+	if request.Hidden {
+		connection["802-11-wireless"]["hidden"] = dbus.MakeVariant(true)
+		if err := probeHiddenNetwork(ctx, conn, device, request.SSID); err != nil {
+			log.Printf("Failed to probe for hidden network %q: %v", request.SSID, err)
 		}
-		fmt.Println("Connecting to open network")
-		connection["802-11-wireless-security"] = map[string]dbus.Variant{
-			"key-mgmt": dbus.MakeVariant("none"),
+	}
+	if request.BSSID != "" {
+		bssid, _ := parseBSSID(request.BSSID)
+		connection["802-11-wireless"]["bssid"] = dbus.MakeVariant([]byte(bssid))
+	}
+	switch request.Band {
+	case dev.WiFiBand_WIFI_BAND_2_4_GHZ:
+		connection["802-11-wireless"]["band"] = dbus.MakeVariant("bg")
+	case dev.WiFiBand_WIFI_BAND_5_GHZ:
+		connection["802-11-wireless"]["band"] = dbus.MakeVariant("a")
+	}
+
+	// Determine the security type based on provided credentials and what the network advertises
+	keyManagement := request.KeyManagement
+	if keyManagement == dev.WiFiKeyManagement_WIFI_KEY_MANAGEMENT_AUTO {
+		keyManagement = detectKeyManagement(conn, device, request)
+	}
+	log.Printf("Connecting to %q using %s", request.SSID, keyManagement)
+	// With automatic key management only now is it known which rules the password has to follow
+	if password, ok := request.GetSecret().(*dev.WiFiConnectRequest_Password); ok {
+		var v violations
+		validatePassword(&v, "password", keyManagement, password.Password)
+		if err := v.err(ErrInvalidConnectRequest); err != nil {
+			return err
 		}
-		break
-	case *dev.WiFiConnectRequest_Password:
-		fmt.Println("Connecting to WPA/WPA2 Personal network")
-		connection["802-11-wireless-security"] = map[string]dbus.Variant{
-			"key-mgmt": dbus.MakeVariant("wpa-psk"),
-			"psk":      dbus.MakeVariant(request.GetSecret().(*dev.WiFiConnectRequest_Password).Password),
+	}
+	if security := securitySettings(keyManagement, request.GetPassword()); security != nil {
+		connection["802-11-wireless-security"] = security
+	}
+
+	// Certificates and stored secrets are kept by the profile's UUID, so it's settled before they're written: a
+	// saved profile for the SSID is reused (and updated) rather than piling up duplicates
+	uuid := newConnectionUUID()
+	var savedProfiles []savedProfile
+	if request.Persist == dev.WiFiPersistMode_WIFI_PERSIST_MODE_ALWAYS {
+		profiles, err := savedWifiProfiles(ctx, conn)
+		if err != nil {
+			return err
 		}
-		break
-	case *dev.WiFiConnectRequest_EapConfig:
-		eapConfig := request.GetSecret().(*dev.WiFiConnectRequest_EapConfig).EapConfig
-		// WPA/WPA2 Enterprise
-		fmt.Println("Connecting to WPA/WPA2 Enterprise network")
-		connection["802-11-wireless-security"] = map[string]dbus.Variant{
-			"key-mgmt": dbus.MakeVariant("wpa-eap"),
+		savedProfiles = profiles[request.SSID]
+		if reuse := profileToReuse(savedProfiles, request.SSID); reuse != nil {
+			uuid = reuse.uuid
 		}
-		connection["802-1x"] = map[string]dbus.Variant{
-			"eap":      dbus.MakeVariant([]string{"tls", "peap", "ttls"}),
-			"identity": dbus.MakeVariant(eapConfig.Identity),
-			"password": dbus.MakeVariant(eapConfig.Password),
+	}
+	connection["connection"]["uuid"] = dbus.MakeVariant(uuid)
+
+	if eapConfig := request.GetEapConfig(); eapConfig != nil {
+		eap, err := eapSettings(eapConfig, uuid)
+		if err != nil {
+			return err
 		}
-		if eapConfig.ClientCertificate != "" {
-			connection["802-1x"]["client-cert"] = dbus.MakeVariant(eapConfig.ClientCertificate)
+		connection["802-1x"] = eap
+	}
+
+	secrets := takeAgentSecrets(store, connection)
+
+	var connPath dbus.ObjectPath
+	if request.Persist == dev.WiFiPersistMode_WIFI_PERSIST_MODE_ALWAYS {
+		var err error
+		connPath, err = upsertWifiProfile(ctx, conn, request.SSID, savedProfiles, connection)
+		if err != nil {
+			return err
 		}
-		if eapConfig.CaCertificate != "" {
-			connection["802-1x"]["ca-cert"] = dbus.MakeVariant(eapConfig.CaCertificate)
+		if request.GetEapConfig() == nil {
+			// The profile may have used EAP before this update
+			removeCertificateFiles(uuid)
 		}
-
-		break
+	}
+	// An unsaved profile is added and activated in one go, so its secrets have to be in place before NM knows it
+	if err := storeAgentSecrets(store, uuid, secrets); err != nil {
+		return err
 	}
 
-	path := dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings")
-	settings := conn.Object("org.freedesktop.NetworkManager", path)
+	activationCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
 
-	// Add the new connection to NetworkManager
-	call := settings.Call("org.freedesktop.NetworkManager.Settings.AddConnection", 0, connection)
-	if call.Err != nil {
-		return fmt.Errorf("failed to add connection: %v", call.Err)
+	// Subscribe before activating so no state change can slip by
+	matchRules := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchPathNamespace("/org/freedesktop/NetworkManager/ActiveConnection"),
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Connection.Active"),
+			dbus.WithMatchMember("StateChanged"),
+		},
+		{
+			dbus.WithMatchObjectPath(device.path),
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Device"),
+			dbus.WithMatchMember("StateChanged"),
+		},
 	}
-
-	// Retrieve the connection path
-	var newConnPath dbus.ObjectPath
-	if err := call.Store(&newConnPath); err != nil {
-		return fmt.Errorf("failed to store new connection path: %v", err)
+	for _, matchRule := range matchRules {
+		if err := conn.AddMatchSignalContext(activationCtx, matchRule...); err != nil {
+			return fmt.Errorf("failed to add signal match: %v", err)
+		}
+		defer conn.RemoveMatchSignal(matchRule...)
 	}
 
-	// Activate the connection
-	devices, err := nm.GetProperty("org.freedesktop.NetworkManager.AllDevices")
-	if err != nil {
-		return fmt.Errorf("failed to get devices: %v", err)
-	}
+	sigChan := make(chan *dbus.Signal, 10)
+	conn.Signal(sigChan)
+	defer conn.RemoveSignal(sigChan)
 
-	var wifiDevice dbus.ObjectPath
-	for _, d := range devices.Value().([]dbus.ObjectPath) {
-		device := conn.Object("org.freedesktop.NetworkManager", d)
-		deviceType, err := device.GetProperty("org.freedesktop.NetworkManager.Device.DeviceType")
+	// Activate the connection
+	var activeConnPath dbus.ObjectPath
+	switch request.Persist {
+	case dev.WiFiPersistMode_WIFI_PERSIST_MODE_ALWAYS:
+		call := nm.CallWithContext(activationCtx, "org.freedesktop.NetworkManager.ActivateConnection", 0, connPath, device.path, dbus.ObjectPath("/"))
+		if call.Err != nil {
+			return fmt.Errorf("failed to activate connection: %v", call.Err)
+		}
+		if err := call.Store(&activeConnPath); err != nil {
+			return fmt.Errorf("failed to store active connection path: %v", err)
+		}
+	case dev.WiFiPersistMode_WIFI_PERSIST_MODE_MEMORY_ONLY, dev.WiFiPersistMode_WIFI_PERSIST_MODE_ON_SUCCESS:
+		// A volatile profile is deleted by NM as soon as it's deactivated, including when the activation fails
+		persist := "volatile"
+		if request.Persist == dev.WiFiPersistMode_WIFI_PERSIST_MODE_MEMORY_ONLY {
+			persist = "memory"
+		}
+		var err error
+		connPath, activeConnPath, err = addAndActivateUnsaved(activationCtx, conn, connection, device.path, persist)
 		if err != nil {
-			continue // Skip on error
+			forgetProfileFiles(store, uuid)
+			return err
 		}
+	default:
+		return fmt.Errorf("%w: unknown persist mode %d", ErrInvalidPersistMode, request.Persist)
+	}
 
-		// Check if the device is a WiFi device (type 2)
-		if deviceType.Value().(uint32) == 2 {
-			wifiDevice = d
-			break
+	// Monitor connection status
+	if err := monitorConnectStatus(activationCtx, sigChan, activeConnPath, device.path, progress); err != nil {
+		switch request.Persist {
+		case dev.WiFiPersistMode_WIFI_PERSIST_MODE_MEMORY_ONLY:
+			discardProfile(conn, store, connPath, uuid)
+		case dev.WiFiPersistMode_WIFI_PERSIST_MODE_ON_SUCCESS:
+			// NM already deleted the volatile profile, but not what was kept for it outside of NM
+			forgetProfileFiles(store, uuid)
 		}
+		return err
 	}
 
-	if wifiDevice == "" {
-		return fmt.Errorf("no WiFi device found")
+	if request.Persist == dev.WiFiPersistMode_WIFI_PERSIST_MODE_ON_SUCCESS {
+		return saveIfConnected(ctx, conn, store, request.SSID, device, connPath, uuid, progress)
 	}
 
-	activeConnPath := nm.Call("org.freedesktop.NetworkManager.ActivateConnection", 0, newConnPath, wifiDevice, dbus.ObjectPath("/"))
-	if activeConnPath.Err != nil {
-		return fmt.Errorf("failed to activate connection: %v", activeConnPath.Err)
+	return nil
+}
+
+const (
+	// persistConnectivityTimeout bounds how long an unsaved profile gets to reach the internet before it's discarded
+	persistConnectivityTimeout = 20 * time.Second
+	// profileSaveTimeout bounds writing a profile to disk once it proved to work
+	profileSaveTimeout = 10 * time.Second
+)
+
+// saveIfConnected saves the unsaved profile connPath (with the given uuid) once the internet can be reached through
+// device, and discards it along with its stored secrets otherwise
+func saveIfConnected(ctx context.Context, conn *dbus.Conn, store *SecretStore, ssid string, device wifiDevice, connPath dbus.ObjectPath, uuid string, progress ProgressFunc) error {
+	progress.report(dev.WiFiOperationStep_WIFI_OPERATION_STEP_VERIFYING_INTERNET)
+	checkCtx, cancel := context.WithTimeout(ctx, persistConnectivityTimeout)
+	err := waitForConnectivity(checkCtx, []string{device.interfaceName})
+	cancel()
+	if err != nil {
+		discardProfile(conn, store, connPath, uuid)
+		return err
 	}
 
-	// Monitor connection status
-	return monitorConnectStatus(ctx, conn)
+	// The check may have used up most of ctx, and a profile that works shouldn't be lost to a deadline now
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), profileSaveTimeout)
+	defer cancel()
+
+	return saveProfile(saveCtx, conn, ssid, connPath)
 }
 
-func monitorConnectStatus(ctx context.Context, conn *dbus.Conn) error {
-	sigChan := make(chan *dbus.Signal, 10)
-	conn.Signal(sigChan)
+// discardProfile deletes a profile that didn't work out, along with its certificates and the secrets store keeps
+// for its uuid. It's called on failure paths where ctx may be done already, so it doesn't take one.
+func discardProfile(conn *dbus.Conn, store *SecretStore, connPath dbus.ObjectPath, uuid string) {
+	if err := deleteConnection(context.Background(), conn, connPath, uuid); err != nil {
+		log.Printf("Failed to delete unsaved connection %s: %v", connPath, err)
+	}
+	forgetAgentSecrets(store, uuid)
+}
+
+// forgetProfileFiles drops what was kept for the profile uuid outside of NM, its stored secrets and certificates,
+// once the profile itself is gone or never made it
+func forgetProfileFiles(store *SecretStore, uuid string) {
+	forgetAgentSecrets(store, uuid)
+	removeCertificateFiles(uuid)
+}
+
+// connectTimeout bounds how long ConnectWiFi waits for the activation to complete
+const connectTimeout = 30 * time.Second
+
+// deviceStateSteps maps the device states an activation goes through to the operation step they stand for
+var deviceStateSteps = map[uint32]dev.WiFiOperationStep{
+	NM_DEVICE_STATE_PREPARE:     dev.WiFiOperationStep_WIFI_OPERATION_STEP_PREPARING,
+	NM_DEVICE_STATE_CONFIG:      dev.WiFiOperationStep_WIFI_OPERATION_STEP_ASSOCIATING,
+	NM_DEVICE_STATE_NEED_AUTH:   dev.WiFiOperationStep_WIFI_OPERATION_STEP_AUTHENTICATING,
+	NM_DEVICE_STATE_IP_CONFIG:   dev.WiFiOperationStep_WIFI_OPERATION_STEP_GETTING_IP,
+	NM_DEVICE_STATE_IP_CHECK:    dev.WiFiOperationStep_WIFI_OPERATION_STEP_GETTING_IP,
+	NM_DEVICE_STATE_SECONDARIES: dev.WiFiOperationStep_WIFI_OPERATION_STEP_GETTING_IP,
+}
+
+// monitorConnectStatus follows the activation at activeConnPath on devicePath until it succeeds, fails or ctx is
+// done, reporting the steps it goes through to progress. Failures come back as Connect errors carrying a
+// WiFiConnectFailure detail.
+func monitorConnectStatus(ctx context.Context, sigChan <-chan *dbus.Signal, activeConnPath, devicePath dbus.ObjectPath, progress ProgressFunc) error {
+	var deviceReason uint32
 
 	for {
 		select {
-		case sig := <-sigChan:
-			if sig.Name == "org.freedesktop.NetworkManager.Connection.Active.StateChanged" {
-				state := sig.Body[0].(uint32)
+		case <-ctx.Done():
+			return connectFailureError(contextConnectFailure(ctx, deviceReason))
+		case sig, ok := <-sigChan:
+			if !ok {
+				return fmt.Errorf("D-Bus connection closed")
+			}
+
+			switch {
+			case sig.Name == "org.freedesktop.NetworkManager.Device.StateChanged" && sig.Path == devicePath:
+				var newState, oldState, reason uint32
+				if err := dbus.Store(sig.Body, &newState, &oldState, &reason); err != nil {
+					continue
+				}
+				if reason != NM_DEVICE_STATE_REASON_NONE {
+					deviceReason = reason
+				}
+				if step, ok := deviceStateSteps[newState]; ok {
+					progress.report(step)
+				}
+				if newState == NM_DEVICE_STATE_FAILED {
+					log.Printf("Device failed to activate (reason %d)", reason)
+					return connectFailureError(connectFailure(0, deviceReason))
+				}
+
+			case sig.Name == "org.freedesktop.NetworkManager.Connection.Active.StateChanged" && sig.Path == activeConnPath:
+				var state, reason uint32
+				if err := dbus.Store(sig.Body, &state, &reason); err != nil {
+					continue
+				}
 				switch state {
-				case 2:
-					fmt.Println("Connection activated")
+				case NM_ACTIVE_CONNECTION_STATE_ACTIVATED:
+					log.Printf("Connection activated")
 					return nil
-				case 3:
-					fmt.Println("Connection deactivated")
-					return fmt.Errorf("connection deactivated")
-				default:
-					fmt.Printf("unknown/unhandled NetworkManager.Connection.Active.StateChanged: %d\n", state)
+				case NM_ACTIVE_CONNECTION_STATE_DEACTIVATED:
+					log.Printf("Connection deactivated (reason %d, device reason %d)", reason, deviceReason)
+					return connectFailureError(connectFailure(reason, deviceReason))
 				}
 			}
-		case <-time.After(30 * time.Second):
-			return fmt.Errorf("connection timeout")
 		}
 	}
 }
@@ -469,7 +851,56 @@ func nmConn(conn *dbus.Conn) dbus.BusObject {
 	return conn.Object(serviceName, "/org/freedesktop/NetworkManager")
 }
 
-func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hotspotPassword string, hotspotInterfaceName string) error {
+// HotspotConfig describes the hotspot StartHotspot brings up
+type HotspotConfig struct {
+	SSID          string
+	Password      string
+	InterfaceName string
+	// Band is 2.4 GHz (the default) or 5 GHz
+	Band dev.WiFiBand
+	// Channel within Band, e.g. from RecommendChannel; 0 lets the driver pick
+	Channel int32
+}
+
+var ErrInvalidHotspotConfig = errors.New("invalid hotspot configuration")
+
+// ValidateHotspotConfig checks config before any existing connection is torn down for it. Violations are reported
+// by the fields of WiFiStartHotspotRequest.
+func ValidateHotspotConfig(config HotspotConfig) error {
+	var v violations
+	validateSSID(&v, "SSID", config.SSID)
+	// The hotspot always uses WPA-PSK
+	if problem := pskProblem(config.Password); problem != "" {
+		v.add("password", "%s", problem)
+	}
+
+	var bandName string
+	var channels []int32
+	switch config.Band {
+	case dev.WiFiBand_WIFI_BAND_UNKNOWN, dev.WiFiBand_WIFI_BAND_2_4_GHZ:
+		bandName, channels = "2.4 GHz", append(append([]int32{}, channels2_4GHz...), 12, 13)
+	case dev.WiFiBand_WIFI_BAND_5_GHZ:
+		bandName, channels = "5 GHz", append(append([]int32{}, channels5GHz...), channels5GHzDFS...)
+	default:
+		v.add("band", "must be 2.4 or 5 GHz, not %s", config.Band)
+	}
+	if config.Channel != 0 && channels != nil && !slices.Contains(channels, config.Channel) {
+		v.add("channel", "%d is not a 20 MHz channel in the %s band", config.Channel, bandName)
+	}
+
+	return v.err(ErrInvalidHotspotConfig)
+}
+
+// hotspotStartTimeout bounds how long StartHotspot waits for the access point to come up
+const hotspotStartTimeout = 30 * time.Second
+
+// StartHotspot replaces any profile for config.SSID with an access point profile and activates it, keeping the
+// password in store when there is one
+func StartHotspot(ctx context.Context, conn *dbus.Conn, store *SecretStore, config HotspotConfig, progress ProgressFunc) (err error) {
+	if err := ValidateHotspotConfig(config); err != nil {
+		return err
+	}
+
 	nmSettings := nmSettingsConn(conn)
 
 	// Check if a hotspot already exists and remove it
@@ -489,12 +920,12 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 
 		settingsCall := busObj.Call("org.freedesktop.NetworkManager.Settings.Connection.GetSettings", 0)
 		if settingsCall.Err != nil {
-			log.Fatalf("Failed to get connection settings: %v", settingsCall.Err)
+			return fmt.Errorf("failed to get connection settings: %v", settingsCall.Err)
 		}
 
 		settingsInfo := map[string]map[string]dbus.Variant{}
 		if err := settingsCall.Store(&settingsInfo); err != nil {
-			log.Fatalf("Failed to store connection settings: %v", err)
+			return fmt.Errorf("failed to store connection settings: %v", err)
 		}
 
 		ssidBytes, ok := settingsInfo["802-11-wireless"]["ssid"].Value().([]byte)
@@ -507,11 +938,11 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 		// print as json
 		b, err := json.Marshal(settingsInfo)
 		if err != nil {
-			log.Fatalf("Failed to marshal connection settings: %v", err)
+			return fmt.Errorf("failed to marshal connection settings: %v", err)
 		}
 		log.Printf("Connection(%s) settings %s\n", ssid, string(b))
 
-		if ssid == hotspotSSID {
+		if ssid == config.SSID {
 			log.Printf("Deleting existing connection: %s", c)
 			if err := busObj.Call("org.freedesktop.NetworkManager.Settings.Connection.Delete", 0).Err; err != nil {
 				return fmt.Errorf("failed to delete existing connection: %v", err)
@@ -521,17 +952,17 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 
 	connectionParams := map[string]dbus.Variant{
 		"type":                 dbus.MakeVariant("802-11-wireless"),
-		"id":                   dbus.MakeVariant(hotspotSSID),
+		"id":                   dbus.MakeVariant(config.SSID),
 		"autoconnect":          dbus.MakeVariant(false),
 		"autoconnect-priority": dbus.MakeVariant(0),
 	}
-	if hotspotInterfaceName != "" {
-		connectionParams["interface-name"] = dbus.MakeVariant(hotspotInterfaceName)
+	if config.InterfaceName != "" {
+		connectionParams["interface-name"] = dbus.MakeVariant(config.InterfaceName)
 	}
 
 	wirelessSecurity := map[string]dbus.Variant{
 		"key-mgmt": dbus.MakeVariant("wpa-psk"),
-		"psk":      dbus.MakeVariant(hotspotPassword),
+		"psk":      dbus.MakeVariant(config.Password),
 	}
 
 	// PMF (Protected Management Frames) causes issues with some cards, but disabling seems to cause the connection
@@ -540,20 +971,51 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 	// So restrict to CCMP (AES) only to avoid security warnings (well, really, avoid security issues)
 	wirelessSecurity["pairwise"] = dbus.MakeVariant([]string{"ccmp"})
 
+	wireless := map[string]dbus.Variant{
+		"ssid":   dbus.MakeVariant([]byte(config.SSID)),
+		"mode":   dbus.MakeVariant("ap"),
+		"band":   dbus.MakeVariant("bg"),
+		"hidden": dbus.MakeVariant(false),
+	}
+	switch config.Band {
+	case dev.WiFiBand_WIFI_BAND_UNKNOWN, dev.WiFiBand_WIFI_BAND_2_4_GHZ:
+	case dev.WiFiBand_WIFI_BAND_5_GHZ:
+		wireless["band"] = dbus.MakeVariant("a")
+	default:
+		return fmt.Errorf("hotspot band must be 2.4 or 5 GHz, not %s", config.Band)
+	}
+	if config.Channel != 0 {
+		wireless["channel"] = dbus.MakeVariant(uint32(config.Channel))
+	}
+
 	// Create a new hotspot connection
 	hotspotConfig := map[string]map[string]dbus.Variant{
-		"connection": connectionParams,
-		"802-11-wireless": {
-			"ssid":   dbus.MakeVariant([]byte(hotspotSSID)),
-			"mode":   dbus.MakeVariant("ap"),
-			"band":   dbus.MakeVariant("bg"),
-			"hidden": dbus.MakeVariant(false),
-		},
+		"connection":               connectionParams,
+		"802-11-wireless":          wireless,
 		"802-11-wireless-security": wirelessSecurity,
 		"ipv4":                     ipv4Data,
 		"ipv6":                     ipv6Data,
 	}
 
+	uuid := newConnectionUUID()
+	connectionParams["uuid"] = dbus.MakeVariant(uuid)
+	if err := storeAgentSecrets(store, uuid, takeAgentSecrets(store, hotspotConfig)); err != nil {
+		return err
+	}
+
+	// A hotspot that didn't come up shouldn't leave its profile or its secrets behind
+	var newConnPath dbus.ObjectPath
+	defer func() {
+		if err == nil {
+			return
+		}
+		if newConnPath != "" {
+			discardProfile(conn, store, newConnPath, uuid)
+		} else {
+			forgetAgentSecrets(store, uuid)
+		}
+	}()
+
 	// Add the new connection to NetworkManager
 	call := nmSettings.Call("org.freedesktop.NetworkManager.Settings.AddConnection", 0, hotspotConfig)
 	if call.Err != nil {
@@ -561,7 +1023,6 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 	}
 
 	// Retrieve the connection path
-	var newConnPath dbus.ObjectPath
 	if err := call.Store(&newConnPath); err != nil {
 		return fmt.Errorf("failed to store new connection path: %v", err)
 	}
@@ -587,12 +1048,12 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 			continue // Skip on error
 		}
 
-		if hotspotInterfaceName != "" {
-			if deviceInterfaceName.Value().(string) != hotspotInterfaceName {
+		if config.InterfaceName != "" {
+			if deviceInterfaceName.Value().(string) != config.InterfaceName {
 				continue
 			}
 
-			log.Printf("Using specified interface: %s", hotspotInterfaceName)
+			log.Printf("Using specified interface: %s", config.InterfaceName)
 			wifiDevice = d
 			break
 		}
@@ -633,80 +1094,51 @@ func StartHotspot(ctx context.Context, conn *dbus.Conn, hotspotSSID string, hots
 		}
 	}
 
-	connActivated := make(chan struct{})
-	go func() {
-		// Monitor connection status
-		if err = conn.AddMatchSignal(
+	// One deadline for the whole activation, however many signals come by
+	activationCtx, cancel := context.WithTimeout(ctx, hotspotStartTimeout)
+	defer cancel()
+
+	// Subscribe before activating so the activation can't slip by
+	matchRules := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchPathNamespace("/org/freedesktop/NetworkManager/ActiveConnection"),
 			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Connection.Active"),
-		); err != nil {
-			panic(err)
+			dbus.WithMatchMember("StateChanged"),
+		},
+		{
+			dbus.WithMatchObjectPath(wifiDevice),
+			dbus.WithMatchInterface("org.freedesktop.NetworkManager.Device"),
+			dbus.WithMatchMember("StateChanged"),
+		},
+	}
+	for _, matchRule := range matchRules {
+		if err := conn.AddMatchSignalContext(activationCtx, matchRule...); err != nil {
+			return fmt.Errorf("failed to add signal match: %v", err)
 		}
+		defer conn.RemoveMatchSignal(matchRule...)
+	}
 
-		err := monitorHotspotStart(ctx, conn, newConnPath)
-		if err != nil {
-			log.Printf("Failed to activate hotspot: %v", err)
-		}
-		close(connActivated)
-	}()
+	sigChan := make(chan *dbus.Signal, 10)
+	conn.Signal(sigChan)
+	defer conn.RemoveSignal(sigChan)
 
 	// Activate the connection
+	progress.report(dev.WiFiOperationStep_WIFI_OPERATION_STEP_STARTING_HOTSPOT)
 	log.Printf("Activating connection: %s", newConnPath)
-	activeConnPath := nm.Call("org.freedesktop.NetworkManager.ActivateConnection", 0, newConnPath, wifiDevice, dbus.ObjectPath("/"))
-	if activeConnPath.Err != nil {
-		return fmt.Errorf("failed to activate connection: %v", activeConnPath.Err)
+	call = nm.CallWithContext(activationCtx, "org.freedesktop.NetworkManager.ActivateConnection", 0, newConnPath, wifiDevice, dbus.ObjectPath("/"))
+	if call.Err != nil {
+		return fmt.Errorf("failed to activate connection: %v", call.Err)
+	}
+	var activeConnPath dbus.ObjectPath
+	if err := call.Store(&activeConnPath); err != nil {
+		return fmt.Errorf("failed to store active connection path: %v", err)
 	}
 
-	<-connActivated
+	// The steps of a client activation don't apply to an access point, so they aren't reported
+	if err := monitorConnectStatus(activationCtx, sigChan, activeConnPath, wifiDevice, nil); err != nil {
+		log.Printf("Failed to start hotspot %s: %v", config.SSID, err)
+		return err
+	}
 
 	return nil
 }
-
-func monitorHotspotStart(ctx context.Context, conn *dbus.Conn, connPath dbus.ObjectPath) error {
-	sigChan := make(chan *dbus.Signal, 10)
-	conn.Signal(sigChan)
-
-	for {
-		select {
-		case sig := <-sigChan:
-			if sig.Name == "org.freedesktop.NetworkManager.Connection.Active.StateChanged" {
-				/*
-					https://github.com/NetworkManager/NetworkManager/blob/99f22526ec6370646b8a54d74b2436e4590abc14/introspection/org.freedesktop.NetworkManager.Device.xml#L400C1-L404C14
-					   <signal name="StateChanged">
-					     <arg name="new_state" type="u"/>
-					     <arg name="old_state" type="u"/>
-					     <arg name="reason" type="u"/>
-					   </signal>
-				*/
-				state := sig.Body[0].(uint32)
-				switch state {
-				case 2:
-
-					// sig.Path will be an '/ActiveConnection/<n>' while connPath is '/Settings/<n>', so we'll ask the 'ActiveConnection' for the 'org.freedesktop.NetworkManager.Connection.Active.Connection' property
-					perhapsConn := conn.Object("org.freedesktop.NetworkManager", sig.Path)
-					connProp, err := perhapsConn.GetProperty("org.freedesktop.NetworkManager.Connection.Active.Connection")
-					if err != nil {
-						log.Printf("Failed to get connection path: %v", err)
-						continue
-					}
-
-					if connProp.Value() != connPath {
-						log.Printf("Unexpected connection path: %s (expected: %s)", connProp.Value(), connPath)
-						continue
-					}
-
-					fmt.Println("Hotspot activated")
-
-					return nil
-				case 3:
-					fmt.Println("Hotspot deactivated")
-					// keep waiting for activation (might be deactivating an existing connection)
-					continue
-				}
-			} else {
-				log.Printf("Unhandled signal: %s // %s // %s", sig.Name, sig.Path, sig.Sender)
-			}
-		case <-time.After(30 * time.Second):
-			return fmt.Errorf("hotspot activation timeout")
-		}
-	}
-}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/uinta-labs/iotnetlab/gen/protos/connections/firm/ware/dev"
+)
+
+func TestFrequencyToBandChannel(t *testing.T) {
+	tests := []struct {
+		name    string
+		freq    int32
+		band    dev.WiFiBand
+		channel int32
+	}{
+		{"2.4 GHz channel 1", 2412, dev.WiFiBand_WIFI_BAND_2_4_GHZ, 1},
+		{"2.4 GHz channel 6", 2437, dev.WiFiBand_WIFI_BAND_2_4_GHZ, 6},
+		{"2.4 GHz channel 13", 2472, dev.WiFiBand_WIFI_BAND_2_4_GHZ, 13},
+		{"2.4 GHz channel 14", 2484, dev.WiFiBand_WIFI_BAND_2_4_GHZ, 14},
+		{"between 2.4 GHz channels 13 and 14", 2477, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"off the 2.4 GHz grid", 2413, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"4.9 GHz lowest", 4910, dev.WiFiBand_WIFI_BAND_5_GHZ, 182},
+		{"4.9 GHz channel 184", 4920, dev.WiFiBand_WIFI_BAND_5_GHZ, 184},
+		{"4.9 GHz highest", 4980, dev.WiFiBand_WIFI_BAND_5_GHZ, 196},
+		{"below 4.9 GHz", 4905, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"5 GHz channel 36", 5180, dev.WiFiBand_WIFI_BAND_5_GHZ, 36},
+		{"5 GHz channel 100", 5500, dev.WiFiBand_WIFI_BAND_5_GHZ, 100},
+		{"5 GHz channel 165", 5825, dev.WiFiBand_WIFI_BAND_5_GHZ, 165},
+		{"5 GHz channel 177", 5885, dev.WiFiBand_WIFI_BAND_5_GHZ, 177},
+		{"6 GHz channel 2", 5935, dev.WiFiBand_WIFI_BAND_6_GHZ, 2},
+		{"6 GHz channel 1", 5955, dev.WiFiBand_WIFI_BAND_6_GHZ, 1},
+		{"6 GHz channel 233", 7115, dev.WiFiBand_WIFI_BAND_6_GHZ, 233},
+		{"between 6 GHz channels 2 and 1", 5945, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"above 6 GHz", 7120, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"60 GHz channel 1", 58320, dev.WiFiBand_WIFI_BAND_60_GHZ, 1},
+		{"60 GHz channel 2", 60480, dev.WiFiBand_WIFI_BAND_60_GHZ, 2},
+		{"60 GHz channel 6", 69120, dev.WiFiBand_WIFI_BAND_60_GHZ, 6},
+		{"802.11ay channel 7", 70200, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"above 60 GHz channel 6", 71280, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"off the 60 GHz grid", 59000, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+		{"unknown", 0, dev.WiFiBand_WIFI_BAND_UNKNOWN, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			band, channel := frequencyToBandChannel(tt.freq)
+			if band != tt.band || channel != tt.channel {
+				t.Errorf("frequencyToBandChannel(%d) = %s, %d; want %s, %d", tt.freq, band, channel, tt.band, tt.channel)
+			}
+		})
+	}
+}
+
+func TestDetermineSecurity(t *testing.T) {
+	const (
+		ccmp = NM_802_11_AP_SEC_PAIR_CCMP | NM_802_11_AP_SEC_GROUP_CCMP
+		tkip = NM_802_11_AP_SEC_PAIR_TKIP | NM_802_11_AP_SEC_GROUP_TKIP
+	)
+
+	tests := []struct {
+		name     string
+		apFlags  uint32
+		wpaFlags uint32
+		rsnFlags uint32
+		want     dev.WiFiSecurityType
+	}{
+		{"open", NM_802_11_AP_FLAGS_NONE, NM_802_11_AP_SEC_NONE, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_OPEN},
+		{"open with WPS", NM_802_11_AP_FLAGS_WPS, NM_802_11_AP_SEC_NONE, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_OPEN},
+		{"legacy WEP, privacy flag only", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_WEP},
+		{"WEP ciphers without key management", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_PAIR_WEP104 | NM_802_11_AP_SEC_GROUP_WEP104, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_WEP},
+		{"WPA personal", NM_802_11_AP_FLAGS_PRIVACY, tkip | NM_802_11_AP_SEC_KEY_MGMT_PSK, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_WPA_PSK},
+		{"WPA enterprise", NM_802_11_AP_FLAGS_PRIVACY, tkip | NM_802_11_AP_SEC_KEY_MGMT_802_1X, NM_802_11_AP_SEC_NONE, dev.WiFiSecurityType_WIFI_SECURITY_WPA_EAP},
+		{"WPA2 personal", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_PSK, dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK},
+		{"WPA/WPA2 mixed personal", NM_802_11_AP_FLAGS_PRIVACY, tkip | NM_802_11_AP_SEC_KEY_MGMT_PSK, ccmp | NM_802_11_AP_SEC_KEY_MGMT_PSK, dev.WiFiSecurityType_WIFI_SECURITY_WPA2_PSK},
+		{"WPA2 enterprise", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_802_1X, dev.WiFiSecurityType_WIFI_SECURITY_WPA2_EAP},
+		{"WPA3 personal", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_SAE, dev.WiFiSecurityType_WIFI_SECURITY_WPA3_PSK},
+		{"WPA2/WPA3 transition", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_PSK | NM_802_11_AP_SEC_KEY_MGMT_SAE, dev.WiFiSecurityType_WIFI_SECURITY_WPA3_TRANSITION},
+		{"WPA3 enterprise 192-bit", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192, dev.WiFiSecurityType_WIFI_SECURITY_WPA3_EAP_192},
+		{"192-bit wins over plain 802.1X", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_802_1X | NM_802_11_AP_SEC_KEY_MGMT_EAP_SUITE_B_192, dev.WiFiSecurityType_WIFI_SECURITY_WPA3_EAP_192},
+		{"enhanced open", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp | NM_802_11_AP_SEC_KEY_MGMT_OWE, dev.WiFiSecurityType_WIFI_SECURITY_OWE},
+		{"open side of an OWE transition pair", NM_802_11_AP_FLAGS_NONE, NM_802_11_AP_SEC_NONE, NM_802_11_AP_SEC_KEY_MGMT_OWE_TM, dev.WiFiSecurityType_WIFI_SECURITY_OWE},
+		{"ciphers without key management", NM_802_11_AP_FLAGS_PRIVACY, NM_802_11_AP_SEC_NONE, ccmp, dev.WiFiSecurityType_WIFI_SECURITY_UNKNOWN},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineSecurity(tt.apFlags, tt.wpaFlags, tt.rsnFlags); got != tt.want {
+				t.Errorf("determineSecurity(%#x, %#x, %#x) = %s, want %s", tt.apFlags, tt.wpaFlags, tt.rsnFlags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHotspotConfig(t *testing.T) {
+	valid := HotspotConfig{SSID: "iotnetlab", Password: "password123"}
+
+	tests := []struct {
+		name   string
+		modify func(config *HotspotConfig)
+		// fields with violations, sorted
+		want []string
+	}{
+		{"valid", func(config *HotspotConfig) {}, nil},
+		{"2.4 GHz channel 13", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_2_4_GHZ, 13 }, nil},
+		{"channel without a band is 2.4 GHz", func(config *HotspotConfig) { config.Channel = 6 }, nil},
+		{"5 GHz channel 36", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_5_GHZ, 36 }, nil},
+		{"5 GHz DFS channel", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_5_GHZ, 100 }, nil},
+		{"5 GHz without a channel", func(config *HotspotConfig) { config.Band = dev.WiFiBand_WIFI_BAND_5_GHZ }, nil},
+		{"missing SSID", func(config *HotspotConfig) { config.SSID = "" }, []string{"SSID"}},
+		{"SSID over 32 bytes", func(config *HotspotConfig) { config.SSID = strings.Repeat("a", 33) }, []string{"SSID"}},
+		{"short password", func(config *HotspotConfig) { config.Password = "short" }, []string{"password"}},
+		{"missing password", func(config *HotspotConfig) { config.Password = "" }, []string{"password"}},
+		{"2.4 GHz channel 14", func(config *HotspotConfig) { config.Channel = 14 }, []string{"channel"}},
+		{"5 GHz channel in 2.4 GHz", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_2_4_GHZ, 36 }, []string{"channel"}},
+		{"2.4 GHz channel in 5 GHz", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_5_GHZ, 6 }, []string{"channel"}},
+		{"5 GHz channel that isn't 20 MHz", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_5_GHZ, 38 }, []string{"channel"}},
+		{"6 GHz", func(config *HotspotConfig) { config.Band, config.Channel = dev.WiFiBand_WIFI_BAND_6_GHZ, 5 }, []string{"band"}},
+		{"everything wrong", func(config *HotspotConfig) {
+			*config = HotspotConfig{Password: "short", Channel: 200}
+		}, []string{"SSID", "channel", "password"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			fields := violationFields(t, ValidateHotspotConfig(config), ErrInvalidHotspotConfig)
+			if !slices.Equal(fields, tt.want) {
+				t.Errorf("violations for %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}